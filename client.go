@@ -9,6 +9,8 @@ import (
 
 type client struct {
 	PatternPosition chan uint64
+	Responses       chan Response
+	Updates         chan Update
 	sequencer       *websocket.Conn
 }
 
@@ -33,23 +35,59 @@ func (self *client) stop() error {
 	return err
 }
 
-func (self *client) receivePosition(origin, host string, port int) {
-	var pos uint64
-	msg := make([]byte, 8)
+// send sends a command to the sequencer. The response
+// will be delivered on the Responses channel.
+func (self *client) send(cmd *Command) error {
+	buf, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	_, err = self.sequencer.Write(buf)
+	return err
+}
+
+// receive reads messages from the sequencer endpoint.
+// Pattern positions are sent on PatternPosition, command
+// responses are sent on Responses and updates broadcast by
+// the sequencer are sent on Updates.
+func (self *client) receive(origin, host string, port int) {
+	var msg []byte
 	for {
-		bytesRead, err := self.sequencer.Read(msg)
+		err := websocket.Message.Receive(self.sequencer, &msg)
 		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			panic(err)
+		}
+		var pos uint64
+		if json.Unmarshal(msg, &pos) == nil {
+			fmt.Printf("received pos %v\n", pos)
+			self.PatternPosition <- pos
 			continue
 		}
+		var probe struct {
+			Seq *uint64 `json:"seq"`
+		}
+		err = json.Unmarshal(msg, &probe)
 		if err != nil {
 			panic(err)
 		}
-		err = json.Unmarshal(msg[:bytesRead], &pos)
+		if probe.Seq != nil {
+			var up Update
+			err = json.Unmarshal(msg, &up)
+			if err != nil {
+				panic(err)
+			}
+			self.Updates <- up
+			continue
+		}
+		var res Response
+		err = json.Unmarshal(msg, &res)
 		if err != nil {
 			panic(err)
 		}
-		fmt.Printf("received pos %v\n", pos)
-		self.PatternPosition <- pos
+		self.Responses <- res
 	}
 }
 
@@ -57,12 +95,14 @@ func newClient(origin string, port int) (*client, error) {
 	var err error
 	c := new(client)
 	c.PatternPosition = make(chan uint64)
+	c.Responses = make(chan Response, 16)
+	c.Updates = make(chan Update, subscriberBuffer)
 	host := "localhost"
 	seqUrl := fmt.Sprintf("ws://%s:%d/sequencer", host, port)
 	c.sequencer, err = websocket.Dial(seqUrl, "", origin)
 	if err != nil {
 		return nil, err
 	}
-	go c.receivePosition(origin, host, port)
+	go c.receive(origin, host, port)
 	return c, nil
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"github.com/lightning/metro"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clock emits the ticks that drive a sequencer, metroSteps
+// ticks per beat at its tempo
+type clock interface {
+	// Run calls tick for every tick the clock emits
+	Run(tick func())
+	Start() error
+	Stop() error
+	// SetTempo sets the tempo in bpm and returns the old tempo
+	SetTempo(bpm float32) float32
+	// AfterFunc calls fn once d has passed on the clock
+	AfterFunc(d time.Duration, fn func())
+}
+
+// metroClock is a clock that ticks in real time
+type metroClock struct {
+	metro.Metro
+}
+
+// Run calls tick from a goroutine for every tick of the metro
+func (self *metroClock) Run(tick func()) {
+	go func() {
+		for _ = range self.Ticks() {
+			tick()
+		}
+	}()
+}
+
+// AfterFunc calls fn from a goroutine after d
+func (self *metroClock) AfterFunc(d time.Duration, fn func()) {
+	time.AfterFunc(d, fn)
+}
+
+// newMetroClock creates a metroClock
+func newMetroClock() *metroClock {
+	return &metroClock{metro.New(120)}
+}
+
+// virtualTimer is a function waiting for a virtualClock
+// to reach a time
+type virtualTimer struct {
+	at time.Duration
+	fn func()
+}
+
+// virtualTimers sorts timers by time
+type virtualTimers []virtualTimer
+
+func (self virtualTimers) Len() int {
+	return len(self)
+}
+
+func (self virtualTimers) Less(i, j int) bool {
+	return self[i].at < self[j].at
+}
+
+func (self virtualTimers) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+// virtualClock is a clock that only ticks when it is advanced,
+// so a sequencer can be played step by step without waiting
+// for real time to pass
+type virtualClock struct {
+	mu      sync.Mutex
+	tick    func()
+	running bool
+	tempo   float32
+	// now is the time the clock has been running for
+	now    time.Duration
+	timers virtualTimers
+}
+
+// Run sets the function called for every tick
+func (self *virtualClock) Run(tick func()) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.tick = tick
+}
+
+// Start lets Advance emit ticks
+func (self *virtualClock) Start() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.running = true
+	return nil
+}
+
+// Stop makes Advance emit no ticks until the clock is started again
+func (self *virtualClock) Stop() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.running = false
+	return nil
+}
+
+// SetTempo sets the tempo in bpm and returns the old tempo
+func (self *virtualClock) SetTempo(bpm float32) float32 {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	old := self.tempo
+	self.tempo = bpm
+	return old
+}
+
+// Tempo returns the tempo in bpm
+func (self *virtualClock) Tempo() float32 {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.tempo
+}
+
+// AfterFunc calls fn when the clock has been advanced past d
+func (self *virtualClock) AfterFunc(d time.Duration, fn func()) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.timers = append(self.timers, virtualTimer{self.now + d, fn})
+}
+
+// Advance moves the clock forward n ticks at its tempo, calling
+// the tick function for each of them and the functions passed to
+// AfterFunc as their time is reached. Ticks and timers are called
+// from the goroutine that calls Advance, so they have finished
+// when it returns. It is an error to advance a stopped clock.
+func (self *virtualClock) Advance(n int) error {
+	for i := 0; i < n; i++ {
+		self.mu.Lock()
+		if !self.running {
+			self.mu.Unlock()
+			return errors.New("clock is not running")
+		}
+		self.now += time.Duration(float64(time.Minute) / float64(self.tempo) / metroSteps)
+		due := self.due()
+		tick := self.tick
+		self.mu.Unlock()
+		for _, timer := range due {
+			timer.fn()
+		}
+		if tick != nil {
+			tick()
+		}
+	}
+	return nil
+}
+
+// due removes the timers that have reached their time and
+// returns them in the order of their times. The caller must hold mu.
+func (self *virtualClock) due() virtualTimers {
+	due, waiting := make(virtualTimers, 0), self.timers[:0]
+	for _, timer := range self.timers {
+		if timer.at <= self.now {
+			due = append(due, timer)
+		} else {
+			waiting = append(waiting, timer)
+		}
+	}
+	self.timers = waiting
+	sort.Stable(due)
+	return due
+}
+
+// newVirtualClock creates a stopped virtualClock
+func newVirtualClock() *virtualClock {
+	return &virtualClock{tempo: 120}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+	"time"
+)
+
+func TestVirtualClock(t *testing.T) {
+	clock := newVirtualClock()
+	ticks := 0
+	clock.Run(func() { ticks += 1 })
+	clock.Start()
+	assert.Equal(t, clock.SetTempo(60), float32(120))
+
+	// ticks are 250ms apart at 60 bpm, and a timer fires
+	// before the first tick at or after its time
+	early, late := -1, -1
+	clock.AfterFunc(300*time.Millisecond, func() { late = ticks })
+	clock.AfterFunc(200*time.Millisecond, func() { early = ticks })
+	assert.Equal(t, clock.Advance(1), nil)
+	assert.Equal(t, early, 0)
+	assert.Equal(t, late, -1)
+	assert.Equal(t, clock.Advance(2), nil)
+	assert.Equal(t, ticks, 3)
+	assert.Equal(t, late, 1)
+}
+
+func TestSequencerClock(t *testing.T) {
+	engine := newNullEngine()
+	clock := newVirtualClock()
+	seq := newSequencer(engine, clock, 8, 120)
+	assert.Equal(t, clock.Tempo(), float32(120))
+	seq.SetTempo(90)
+	assert.Equal(t, clock.Tempo(), float32(90))
+	seq.SetMeter("", &Meter{4, 4, 3})
+	assert.Equal(t, clock.Tempo(), float32(67.5))
+
+	// the swung note at 1 plays after the note at 2 is added,
+	// but before the note at 2 plays
+	seq.SetSwing("", 0.5)
+	seq.AddTo("", 0, NewNote("kick", 60, 100))
+	seq.AddTo("", 1, NewNote("hat", 60, 100))
+	seq.AddTo("", 2, NewNote("snare", 60, 100))
+	seq.Start()
+	clock.Advance(2)
+	played := engine.Played()
+	assert.Equal(t, len(played), 1)
+	assert.Equal(t, played[0].Note.Sample, "kick")
+	clock.Advance(1)
+	played = engine.Played()
+	assert.Equal(t, len(played), 3)
+	assert.Equal(t, played[1].Note.Sample, "hat")
+	assert.Equal(t, played[2].Note.Sample, "snare")
+	assert.Equal(t, seq.Position().Pos, uint64(2))
+}
+
+func TestSequencerClockStop(t *testing.T) {
+	engine := newNullEngine()
+	clock := newVirtualClock()
+	seq := newSequencer(engine, clock, 8, 120)
+	seq.SetSwing("", 0.5)
+	seq.AddTo("", 0, NewNote("kick", 60, 100))
+	seq.AddTo("", 1, NewNote("hat", 60, 100))
+	seq.Start()
+	clock.Advance(2)
+	assert.Equal(t, velocities(engine), []string{"kick 100"})
+
+	// the swung note is not played once the sequencer stops
+	seq.Stop()
+	seq.Start()
+	clock.Advance(1)
+	assert.Equal(t, velocities(engine), []string{"kick 100"})
+
+	// or once the bank is replaced
+	clock.Advance(7)
+	assert.Equal(t, velocities(engine), []string{"kick 100", "kick 100"})
+	seq.SetBank(seq.Bank())
+	clock.Advance(1)
+	assert.Equal(t, velocities(engine), []string{"kick 100", "kick 100", "kick 100"})
+}
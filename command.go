@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// commands understood by the /sequencer endpoint
+const (
+	commandAdd    = "add"
+	commandRemove = "remove"
+	commandClear  = "clear"
+	commandSave   = "save"
+	// pattern bank and song commands
+	commandCreate    = "pattern.create"
+	commandDuplicate = "pattern.duplicate"
+	commandDelete    = "pattern.delete"
+	commandMove      = "pattern.move"
+	commandSwitch    = "pattern.switch"
+	commandSong      = "song.set"
+	// track commands
+	commandAddTrack    = "track.add"
+	commandSetTrack    = "track.set"
+	commandDeleteTrack = "track.delete"
+	// groove commands
+	commandSwing        = "swing"
+	commandGroove       = "groove"
+	commandDefineGroove = "groove.define"
+	// sets the time signature and steps per beat of a pattern
+	commandMeter = "meter"
+	// loop region and pattern length commands
+	commandLoop   = "loop"
+	commandResize = "pattern.resize"
+	// history commands
+	commandUndo  = "undo"
+	commandRedo  = "redo"
+	commandBatch = "batch"
+)
+
+// Command is a typed request sent to the /sequencer endpoint.
+// Every command is answered with a Response carrying the same id,
+// so clients can wait for the backend to confirm an edit before
+// they display it.
+// Pattern names the pattern a command applies to, an empty
+// Pattern means the playing pattern. Name, Length and Song are
+// only used by the pattern bank and song commands, Track by the
+// track commands, Swing and Groove by the groove commands,
+// Meter by the meter command and Loop by the loop command.
+// A loop command without a Loop removes the pattern's loop.
+// Commands are the add, remove and clear commands of a batch,
+// which are applied together and undone in a single step.
+// Index is the new index of a pattern in the bank or the index
+// of a track.
+type Command struct {
+	ID       string      `json:"id"`
+	Command  string      `json:"command"`
+	Pattern  string      `json:"pattern,omitempty"`
+	Event    *Event      `json:"event,omitempty"`
+	Name     string      `json:"name,omitempty"`
+	Length   int         `json:"length,omitempty"`
+	Index    int         `json:"index,omitempty"`
+	Song     []SongEntry `json:"song,omitempty"`
+	Track    *Track      `json:"track,omitempty"`
+	Swing    float64     `json:"swing,omitempty"`
+	Groove   *Groove     `json:"groove,omitempty"`
+	Meter    *Meter      `json:"meter,omitempty"`
+	Loop     *Loop       `json:"loop,omitempty"`
+	Commands []*Command  `json:"commands,omitempty"`
+}
+
+func (self *Command) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(self)
+}
+
+func ReadCommand(r io.Reader) (*Command, error) {
+	dec, pc := json.NewDecoder(r), new(Command)
+	ed := dec.Decode(pc)
+	if ed != nil {
+		return nil, ed
+	}
+	return pc, nil
+}
+
+// execute applies a command to the sequencer, broadcasts the
+// change to every client and returns the response that should
+// be sent back to the client that sent the command
+func (self *server) execute(cmd *Command) Response {
+	var err error
+	code := codeInvalid
+	if cmd.Command == commandSave {
+		err = self.save()
+		code = codeInternal
+	} else {
+		err = self.hub.publish(func() (*Update, error) {
+			cmd := self.resolve(cmd)
+			up, err := self.apply(cmd)
+			if err != nil {
+				return nil, err
+			}
+			up.record = &logRecord{Type: recordCommand, Command: cmd}
+			if cmd.Command == commandUndo || cmd.Command == commandRedo {
+				// the history is not logged, so the notes
+				// that were restored are
+				up.record = &logRecord{Type: recordChanges, Changes: up.Changes}
+			}
+			return up, nil
+		})
+	}
+	if err != nil {
+		return errorResponse(cmd.ID, err, code)
+	}
+	return Response{cmd.ID, "ok", cmd.Command, ""}
+}
+
+// editsPattern returns true if a command edits the pattern
+// named by its Pattern field, or the playing pattern if the
+// field is empty
+func editsPattern(command string) bool {
+	switch command {
+	case commandAdd, commandRemove, commandClear, commandDuplicate,
+		commandAddTrack, commandSetTrack, commandDeleteTrack,
+		commandSwing, commandGroove, commandMeter, commandLoop, commandResize:
+		return true
+	}
+	return false
+}
+
+// resolve returns a copy of a command, and of the commands in
+// a batch, that names the playing pattern instead of leaving its
+// Pattern empty. The playing pattern changes at bar boundaries,
+// which do not happen while the session log is replayed, so
+// commands are logged and broadcast with the pattern they edited.
+// Groove commands likewise hold the template they refer to,
+// since templates are not saved with the project.
+func (self *server) resolve(cmd *Command) *Command {
+	resolved := *cmd
+	if editsPattern(cmd.Command) {
+		resolved.Pattern = self.patternName(cmd.Pattern)
+	}
+	if cmd.Command == commandGroove {
+		groove, err := self.groove(cmd.Groove)
+		if err == nil {
+			resolved.Groove = groove
+		}
+	}
+	if len(cmd.Commands) > 0 {
+		resolved.Commands = make([]*Command, len(cmd.Commands))
+		for i, c := range cmd.Commands {
+			resolved.Commands[i] = self.resolve(c)
+		}
+	}
+	return &resolved
+}
+
+// patternName returns name, or the name of the playing
+// pattern if name is empty
+func (self *server) patternName(name string) string {
+	if name == "" {
+		return self.seq.Playing()
+	}
+	return name
+}
+
+// apply applies a command to the sequencer and returns
+// the update that should be broadcast to all clients
+func (self *server) apply(cmd *Command) (*Update, error) {
+	var err error
+	switch cmd.Command {
+	case commandAdd, commandRemove, commandClear:
+		err = self.applyEvent(cmd)
+		if err != nil {
+			return nil, err
+		}
+		return &Update{Type: cmd.Command, Pattern: cmd.Pattern, Event: cmd.Event}, nil
+	case commandCreate:
+		length := cmd.Length
+		if length == 0 {
+			length = patternLength
+		}
+		err = self.seq.CreatePattern(cmd.Pattern, length)
+	case commandDuplicate:
+		err = self.seq.DuplicatePattern(cmd.Pattern, cmd.Name)
+	case commandDelete:
+		err = self.seq.DeletePattern(cmd.Pattern)
+	case commandMove:
+		err = self.seq.MovePattern(cmd.Pattern, cmd.Index)
+	case commandSong:
+		err = self.seq.SetSong(cmd.Song)
+	case commandSwitch:
+		err = self.seq.SwitchPattern(cmd.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return &Update{Type: updateSwitch, Pattern: cmd.Pattern}, nil
+	case commandAddTrack, commandSetTrack, commandDeleteTrack:
+		err = self.applyTrack(cmd)
+		if err != nil {
+			return nil, err
+		}
+		index := cmd.Index
+		return &Update{Type: cmd.Command, Pattern: cmd.Pattern, Index: &index, Track: cmd.Track}, nil
+	case commandSwing:
+		err = self.seq.SetSwing(cmd.Pattern, cmd.Swing)
+		if err != nil {
+			return nil, err
+		}
+		swing := cmd.Swing
+		return &Update{Type: cmd.Command, Pattern: cmd.Pattern, Swing: &swing}, nil
+	case commandGroove:
+		groove, err := self.groove(cmd.Groove)
+		if err == nil {
+			err = self.seq.SetGroove(cmd.Pattern, groove)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &Update{Type: cmd.Command, Pattern: cmd.Pattern, Groove: groove}, nil
+	case commandDefineGroove:
+		if cmd.Groove == nil {
+			return nil, errors.New(cmd.Command + " requires a groove")
+		}
+		err = registerGroove(cmd.Groove)
+		if err != nil {
+			return nil, err
+		}
+		return &Update{Type: cmd.Command, Groove: cmd.Groove}, nil
+	case commandMeter:
+		err = self.seq.SetMeter(cmd.Pattern, cmd.Meter)
+		if err != nil {
+			return nil, err
+		}
+		return &Update{Type: cmd.Command, Pattern: cmd.Pattern, Meter: cmd.Meter}, nil
+	case commandLoop:
+		err = self.seq.SetLoop(cmd.Pattern, cmd.Loop)
+		if err != nil {
+			return nil, err
+		}
+		return &Update{Type: cmd.Command, Pattern: cmd.Pattern, Loop: cmd.Loop}, nil
+	case commandResize:
+		err = self.seq.Resize(cmd.Pattern, cmd.Length)
+		if err != nil {
+			return nil, err
+		}
+		return &Update{Type: cmd.Command, Pattern: cmd.Pattern, Length: cmd.Length}, nil
+	case commandUndo, commandRedo:
+		undo := self.seq.Undo
+		if cmd.Command == commandRedo {
+			undo = self.seq.Redo
+		}
+		changes, err := undo()
+		if err != nil {
+			return nil, err
+		}
+		return &Update{Type: cmd.Command, Changes: changes}, nil
+	case commandBatch:
+		err = self.seq.Batch(func() error {
+			return self.applyBatch(cmd.Commands)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &Update{Type: cmd.Command, Commands: cmd.Commands}, nil
+	default:
+		return nil, &requestError{codeUnknown, fmt.Sprintf("unrecognized sequencer command %s", cmd.Command)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return self.bankUpdate(), nil
+}
+
+// applyEvent applies a command that edits the notes in a pattern
+func (self *server) applyEvent(cmd *Command) error {
+	ev := cmd.Event
+	if ev == nil {
+		return errors.New(cmd.Command + " requires an event")
+	}
+	if ev.Note == nil && cmd.Command != commandClear {
+		return errors.New(cmd.Command + " requires a note")
+	}
+	switch cmd.Command {
+	case commandAdd:
+		return self.seq.AddTo(cmd.Pattern, ev.Pos, ev.Note)
+	case commandRemove:
+		return self.seq.RemoveFrom(cmd.Pattern, ev.Pos, ev.Note)
+	}
+	return self.seq.Clear(cmd.Pattern, ev.Pos)
+}
+
+// applyBatch applies the note edits of a batch command
+func (self *server) applyBatch(cmds []*Command) error {
+	for i, cmd := range cmds {
+		switch cmd.Command {
+		case commandAdd, commandRemove, commandClear:
+		default:
+			return fmt.Errorf("batch command %d: %s can not be batched", i, cmd.Command)
+		}
+		err := self.applyEvent(cmd)
+		if err != nil {
+			return fmt.Errorf("batch command %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// applyTrack applies a command that changes the tracks in a pattern
+func (self *server) applyTrack(cmd *Command) error {
+	switch cmd.Command {
+	case commandAddTrack:
+		return self.seq.AddTrack(cmd.Pattern, cmd.Track)
+	case commandSetTrack:
+		return self.seq.SetTrack(cmd.Pattern, cmd.Index, cmd.Track)
+	}
+	return self.seq.DeleteTrack(cmd.Pattern, cmd.Index)
+}
+
+// groove returns the groove a groove command sets. A groove
+// that only has a name refers to a groove template, and no
+// groove at all removes the pattern's groove.
+func (self *server) groove(groove *Groove) (*Groove, error) {
+	if groove == nil || len(groove.Offsets) > 0 || len(groove.Velocities) > 0 {
+		return groove, nil
+	}
+	return lookupGroove(groove.Name)
+}
+
+// bankUpdate returns an update describing the
+// pattern bank and the song
+func (self *server) bankUpdate() *Update {
+	return &Update{
+		Type:     updateBank,
+		Patterns: self.seq.Patterns(),
+		Song:     self.seq.Song(),
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestCommandReadJson(t *testing.T) {
+	bs := []byte(`{"id":"a1","command":"add","event":{"pos":3,"note":{"sample":"kick","number":60,"velocity":100}}}`)
+	cmd, err := ReadCommand(bytes.NewReader(bs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, cmd.ID, "a1")
+	assert.Equal(t, cmd.Command, "add")
+	assert.Equal(t, cmd.Event.Pos, uint64(3))
+	assert.Equal(t, cmd.Event.Note.Sample, "kick")
+	assert.Equal(t, cmd.Event.Note.Number, int32(60))
+}
+
+func TestCommandExecute(t *testing.T) {
+	srv := newTestServer(t)
+	note := NewNote("kick", 60, 100)
+
+	res := srv.execute(&Command{ID: "1", Command: "add", Event: &Event{2, note}})
+	assert.Equal(t, res, Response{"1", "ok", "add", ""})
+	notes := srv.seq.NotesAt("", 2)
+	assert.Equal(t, len(notes), 1)
+	assert.Equal(t, notes[0].Sample, "kick")
+
+	res = srv.execute(&Command{ID: "2", Command: "remove", Event: &Event{2, note}})
+	assert.Equal(t, res, Response{"2", "ok", "remove", ""})
+	if srv.seq.NotesAt("", 2)[0] != nil {
+		t.Fatalf("failed to remove note")
+	}
+
+	srv.execute(&Command{ID: "3", Command: "add", Event: &Event{2, note}})
+	res = srv.execute(&Command{ID: "4", Command: "clear", Event: &Event{Pos: 2}})
+	assert.Equal(t, res, Response{"4", "ok", "clear", ""})
+	assert.Equal(t, len(srv.seq.NotesAt("", 2)), 0)
+}
+
+func TestCommandExecuteErrors(t *testing.T) {
+	srv := newTestServer(t)
+	note := NewNote("kick", 60, 100)
+
+	res := srv.execute(&Command{ID: "1", Command: "add", Event: &Event{16, note}})
+	assert.Equal(t, res, Response{"1", "error", "pos (16) greater than pattern length (16)", codeInvalid})
+
+	res = srv.execute(&Command{ID: "2", Command: "add"})
+	assert.Equal(t, res, Response{"2", "error", "add requires an event", codeInvalid})
+
+	res = srv.execute(&Command{ID: "3", Command: "remove", Event: &Event{Pos: 0}})
+	assert.Equal(t, res, Response{"3", "error", "remove requires a note", codeInvalid})
+
+	res = srv.execute(&Command{ID: "4", Command: "transpose", Event: &Event{0, note}})
+	assert.Equal(t, res, Response{"4", "error", "unrecognized sequencer command transpose", codeUnknown})
+}
+
+func TestCommandExecutePatterns(t *testing.T) {
+	srv := newTestServer(t)
+	updates := srv.hub.subscribe()
+
+	res := srv.execute(&Command{ID: "1", Command: "pattern.create", Pattern: "verse", Length: 32})
+	assert.Equal(t, res, Response{"1", "ok", "pattern.create", ""})
+	up := <-updates
+	assert.Equal(t, up.Type, "bank")
+	assert.Equal(t, up.Patterns, []string{"main", "verse"})
+
+	note := NewNote("kick", 60, 100)
+	res = srv.execute(&Command{ID: "2", Command: "add", Pattern: "verse", Event: &Event{20, note}})
+	assert.Equal(t, res, Response{"2", "ok", "add", ""})
+	assert.Equal(t, (<-updates).Pattern, "verse")
+	assert.Equal(t, len(srv.seq.NotesAt("verse", 20)), 1)
+
+	res = srv.execute(&Command{ID: "3", Command: "song.set", Song: []SongEntry{{"verse", 2}}})
+	assert.Equal(t, res, Response{"3", "ok", "song.set", ""})
+	assert.Equal(t, (<-updates).Song, []SongEntry{{"verse", 2}})
+
+	res = srv.execute(&Command{ID: "4", Command: "pattern.switch", Pattern: "chorus"})
+	assert.Equal(t, res, Response{"4", "error", "pattern chorus does not exist", codeInvalid})
+}
+
+func TestCommandExecuteTracks(t *testing.T) {
+	srv := newTestServer(t)
+	updates := srv.hub.subscribe()
+
+	res := srv.execute(&Command{ID: "1", Command: "track.add", Track: &Track{Name: "kick", Sample: "kick.wav"}})
+	assert.Equal(t, res, Response{"1", "ok", "track.add", ""})
+	assert.Equal(t, (<-updates).Track.Name, "kick")
+
+	res = srv.execute(&Command{ID: "2", Command: "track.set", Index: 0, Track: &Track{Name: "kick", Mute: true}})
+	assert.Equal(t, res, Response{"2", "ok", "track.set", ""})
+	up := <-updates
+	assert.Equal(t, up.Track.Mute, true)
+	assert.Equal(t, *up.Index, 0)
+	assert.Equal(t, srv.seq.Bank().Patterns[0].Tracks[0].Mute, true)
+
+	res = srv.execute(&Command{ID: "3", Command: "track.delete", Index: 1})
+	assert.Equal(t, res, Response{"3", "error", "track (1) does not exist in pattern with 1 tracks", codeInvalid})
+}
+
+func TestCommandExecuteGroove(t *testing.T) {
+	restoreGrooves(t)
+	srv := newTestServer(t)
+	updates := srv.hub.subscribe()
+
+	res := srv.execute(&Command{ID: "1", Command: "swing", Swing: 0.3})
+	assert.Equal(t, res, Response{"1", "ok", "swing", ""})
+	assert.Equal(t, *(<-updates).Swing, 0.3)
+	res = srv.execute(&Command{ID: "1", Command: "swing"})
+	assert.Equal(t, res, Response{"1", "ok", "swing", ""})
+	assert.Equal(t, *(<-updates).Swing, 0.0)
+
+	// a groove with only a name refers to a template
+	res = srv.execute(&Command{ID: "2", Command: "groove", Groove: &Groove{Name: "shuffle"}})
+	assert.Equal(t, res, Response{"2", "ok", "groove", ""})
+	assert.Equal(t, len((<-updates).Groove.Offsets), 4)
+	assert.Equal(t, srv.seq.Bank().Patterns[0].Groove.Name, "shuffle")
+
+	res = srv.execute(&Command{ID: "3", Command: "groove", Groove: &Groove{Name: "missing"}})
+	assert.Equal(t, res, Response{"3", "error", "groove missing does not exist", codeInvalid})
+
+	res = srv.execute(&Command{ID: "4", Command: "groove.define", Groove: &Groove{Name: "missing", Offsets: []float64{0, 0.2}}})
+	assert.Equal(t, res, Response{"4", "ok", "groove.define", ""})
+	<-updates
+	res = srv.execute(&Command{ID: "5", Command: "groove", Groove: &Groove{Name: "missing"}})
+	assert.Equal(t, res, Response{"5", "ok", "groove", ""})
+}
+
+func TestCommandExecuteMeter(t *testing.T) {
+	srv := newTestServer(t)
+	updates := srv.hub.subscribe()
+
+	res := srv.execute(&Command{ID: "1", Command: "meter", Meter: &Meter{3, 4, 6}})
+	assert.Equal(t, res, Response{"1", "ok", "meter", ""})
+	assert.Equal(t, (<-updates).Meter, &Meter{3, 4, 6})
+	assert.Equal(t, srv.seq.Bank().Patterns[0].Meter, &Meter{3, 4, 6})
+
+	res = srv.execute(&Command{ID: "2", Command: "meter", Meter: &Meter{3, 5, 6}})
+	assert.Equal(t, res, Response{"2", "error", "beat unit (5) must be a power of 2", codeInvalid})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"github.com/lightning/lightning"
+	"sync"
+	"time"
+)
+
+// engine plays notes. lightning.Engine plays them through JACK,
+// nullEngine records them so lightningd can run without audio.
+// Engines play a note until its sample ends, only engines that
+// also have a StopNote method can stop notes that have a duration
+// earlier, see noteStopper.
+type engine interface {
+	PlayNote(note *lightning.Note) error
+	Connect(ch1, ch2 string) error
+	Close()
+}
+
+// PlayedNote is a note played by a nullEngine and when it was played
+type PlayedNote struct {
+	Note lightning.Note `json:"note"`
+	Time time.Time      `json:"time"`
+}
+
+// nullEngine is an engine that records the notes it is asked
+// to play instead of playing them
+type nullEngine struct {
+	mu     sync.Mutex
+	played []PlayedNote
+	closed bool
+}
+
+// PlayNote records a note
+func (self *nullEngine) PlayNote(note *lightning.Note) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return fmt.Errorf("can not play %s on a closed engine", note.Sample)
+	}
+	self.played = append(self.played, PlayedNote{*note, time.Now()})
+	return nil
+}
+
+// Connect does nothing, there are no outputs to connect
+func (self *nullEngine) Connect(ch1, ch2 string) error {
+	return nil
+}
+
+// Close stops the engine from playing notes
+func (self *nullEngine) Close() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.closed = true
+}
+
+// Played returns the notes that have been played, in the
+// order they were played
+func (self *nullEngine) Played() []PlayedNote {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return append([]PlayedNote(nil), self.played...)
+}
+
+// newNullEngine creates a nullEngine that has not played any notes
+func newNullEngine() *nullEngine {
+	return new(nullEngine)
+}
+
+// newEngine creates the engine with a name, which is
+// either jack or null
+func newEngine(name string) (engine, error) {
+	switch name {
+	case "jack":
+		return lightning.NewEngine(), nil
+	case "null":
+		return newNullEngine(), nil
+	}
+	return nil, fmt.Errorf("unknown engine %s", name)
+}
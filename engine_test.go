@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestNullEngine(t *testing.T) {
+	engine := newNullEngine()
+	seq := newSequencer(engine, newVirtualClock(), 16, 120)
+	seq.AddTo("", 0, NewNote("kick", 60, 100))
+	seq.AddTo("", 2, NewNote("snare", 62, 90))
+
+	steps(t, seq, 4)
+	played := engine.Played()
+	assert.Equal(t, len(played), 2)
+	assert.Equal(t, played[0].Note.Sample, "kick")
+	assert.Equal(t, played[1].Note.Sample, "snare")
+	assert.Equal(t, played[1].Note.Velocity, int32(90))
+	assert.Equal(t, played[0].Time.After(played[1].Time), false)
+
+	engine.Close()
+	assert.Equal(t, engine.PlayNote(&played[0].Note).Error(), "can not play kick on a closed engine")
+}
+
+func TestNewEngine(t *testing.T) {
+	engine, err := newEngine("null")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, engine.Connect("system:playback_1", "system:playback_2"), nil)
+	_, err = newEngine("alsa")
+	assert.Equal(t, err.Error(), "unknown engine alsa")
+}
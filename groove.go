@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Groove is a template of timing offsets and velocity scales
+// that is applied to the notes of a pattern.
+// Offsets delay the notes at each step by a fraction of a step,
+// and Velocities scale their velocity. Both repeat from the
+// start of the pattern, so a groove with 16 offsets applies to
+// every bar of 4/4.
+type Groove struct {
+	Name       string    `json:"name"`
+	Offsets    []float64 `json:"offsets,omitempty"`
+	Velocities []float64 `json:"velocities,omitempty"`
+}
+
+// validate returns an error if the groove can not be played
+func (self *Groove) validate() error {
+	if self.Name == "" {
+		return errors.New("groove name can not be empty")
+	}
+	for i, offset := range self.Offsets {
+		if offset < 0 || offset >= 1 {
+			return fmt.Errorf("groove offset %d (%g) must be from 0 up to 1", i, offset)
+		}
+	}
+	for i, scale := range self.Velocities {
+		if scale < 0 {
+			return fmt.Errorf("groove velocity %d (%g) can not be negative", i, scale)
+		}
+	}
+	return nil
+}
+
+// grooves are the groove templates that patterns can use by name
+var grooves = struct {
+	sync.Mutex
+	templates map[string]*Groove
+}{templates: make(map[string]*Groove)}
+
+// registerGroove adds a groove template, replacing any
+// template with the same name
+func registerGroove(groove *Groove) error {
+	err := groove.validate()
+	if err != nil {
+		return err
+	}
+	grooves.Lock()
+	defer grooves.Unlock()
+	grooves.templates[groove.Name] = groove
+	return nil
+}
+
+// lookupGroove returns the groove template with the given name
+func lookupGroove(name string) (*Groove, error) {
+	grooves.Lock()
+	defer grooves.Unlock()
+	groove, exists := grooves.templates[name]
+	if !exists {
+		return nil, fmt.Errorf("groove %s does not exist", name)
+	}
+	return groove, nil
+}
+
+func init() {
+	// accent the beats and lean back on the last sixteenth of each
+	registerGroove(&Groove{
+		Name:       "shuffle",
+		Offsets:    []float64{0, 0, 0, 0.2},
+		Velocities: []float64{1, 0.8, 0.9, 0.75},
+	})
+	// drag the backbeats in a bar of 4/4
+	registerGroove(&Groove{
+		Name: "laidback",
+		Offsets: []float64{
+			0, 0.05, 0, 0.05, 0.15, 0.05, 0, 0.05,
+			0, 0.05, 0, 0.05, 0.15, 0.05, 0, 0.05,
+		},
+	})
+	// accent the first sixteenth of every beat
+	registerGroove(&Groove{
+		Name:       "accent",
+		Velocities: []float64{1, 0.7, 0.85, 0.7},
+	})
+}
+
+// SetSwing sets the pattern's swing amount
+func (self *Pattern) SetSwing(swing float64) error {
+	if swing < 0 || swing > 1 {
+		return fmt.Errorf("swing (%g) must be from 0 to 1", swing)
+	}
+	self.Swing = swing
+	return nil
+}
+
+// SetGroove sets the pattern's groove. A nil groove
+// removes the pattern's groove.
+func (self *Pattern) SetGroove(groove *Groove) error {
+	if groove != nil {
+		err := groove.validate()
+		if err != nil {
+			return err
+		}
+	}
+	self.Groove = groove
+	return nil
+}
+
+// feel returns the delay, as a fraction of a step, and
+// the velocity scale for notes played at pos.
+// Swing delays every second step by up to half a step.
+func (self *Pattern) feel(pos uint64) (float64, float64) {
+	delay, scale := 0.0, 1.0
+	if pos%2 == 1 {
+		delay += self.Swing / 2
+	}
+	if groove := self.Groove; groove != nil {
+		if n := uint64(len(groove.Offsets)); n > 0 {
+			delay += groove.Offsets[pos%n]
+		}
+		if n := uint64(len(groove.Velocities)); n > 0 {
+			scale = groove.Velocities[pos%n]
+		}
+	}
+	if delay >= 1 {
+		// never delay a note past the next step
+		delay = 0.99
+	}
+	return delay, scale
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"testing"
+	"time"
+)
+
+func TestPatternSwing(t *testing.T) {
+	pat := NewPattern(4)
+	err := pat.SetSwing(0.5)
+	assert.Equal(t, err, nil)
+	delay, scale := pat.feel(0)
+	assert.Equal(t, delay, 0.0)
+	assert.Equal(t, scale, 1.0)
+	// every second step is delayed
+	delay, _ = pat.feel(1)
+	assert.Equal(t, delay, 0.25)
+	delay, _ = pat.feel(2)
+	assert.Equal(t, delay, 0.0)
+
+	err = pat.SetSwing(1.5)
+	assert.Equal(t, err.Error(), "swing (1.5) must be from 0 to 1")
+}
+
+func TestPatternGroove(t *testing.T) {
+	pat := NewPattern(8)
+	err := pat.SetGroove(&Groove{
+		Name:       "test",
+		Offsets:    []float64{0, 0.1},
+		Velocities: []float64{1, 0.5, 0.25},
+	})
+	assert.Equal(t, err, nil)
+	delay, scale := pat.feel(3)
+	assert.Equal(t, delay, 0.1)
+	assert.Equal(t, scale, 1.0)
+	delay, scale = pat.feel(4)
+	assert.Equal(t, delay, 0.0)
+	assert.Equal(t, scale, 0.5)
+
+	// swing and groove offsets add up, but never
+	// delay a note past the next step
+	pat.SetSwing(1)
+	pat.SetGroove(&Groove{Name: "late", Offsets: []float64{0.9}})
+	delay, _ = pat.feel(1)
+	assert.Equal(t, delay, 0.99)
+
+	err = pat.SetGroove(&Groove{Name: "early", Offsets: []float64{-0.1}})
+	assert.Equal(t, err.Error(), "groove offset 0 (-0.1) must be from 0 up to 1")
+	err = pat.SetGroove(nil)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, pat.Groove, (*Groove)(nil))
+}
+
+// restoreGrooves puts back the groove templates that are
+// registered when the test starts once it has finished
+func restoreGrooves(t *testing.T) {
+	grooves.Lock()
+	templates := make(map[string]*Groove)
+	for name, groove := range grooves.templates {
+		templates[name] = groove
+	}
+	grooves.Unlock()
+	t.Cleanup(func() {
+		grooves.Lock()
+		grooves.templates = templates
+		grooves.Unlock()
+	})
+}
+
+func TestGrooveTemplates(t *testing.T) {
+	restoreGrooves(t)
+	groove, err := lookupGroove("shuffle")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, groove.Name, "shuffle")
+	_, err = lookupGroove("polka")
+	assert.Equal(t, err.Error(), "groove polka does not exist")
+
+	err = registerGroove(&Groove{Name: "polka", Velocities: []float64{1, 0.5}})
+	assert.Equal(t, err, nil)
+	groove, err = lookupGroove("polka")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, groove.Velocities, []float64{1, 0.5})
+}
+
+func TestPatternGrooveJson(t *testing.T) {
+	pat := NewPattern(1)
+	pat.SetSwing(0.25)
+	pat.SetGroove(&Groove{Name: "drag", Offsets: []float64{0, 0.1}})
+	expected := `{"length":1,"notes":[null],"swing":0.25,"groove":{"name":"drag","offsets":[0,0.1]}}`
+	bs, err := json.Marshal(pat)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(bs), expected)
+	// the groove is kept when the pattern is copied
+	assert.Equal(t, pat.Copy("copy").Groove, pat.Groove)
+}
+
+func TestSequencerStepDuration(t *testing.T) {
+	seq := newSequencer(nil, newVirtualClock(), 16, 120)
+	assert.Equal(t, seq.stepDuration(), 125*time.Millisecond)
+	seq.SetTempo(60)
+	assert.Equal(t, seq.stepDuration(), 250*time.Millisecond)
+}
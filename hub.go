@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+)
+
+// subscriberBuffer is the number of updates that are queued
+// for a subscriber before further updates are dropped.
+// Subscribers can detect dropped updates with Update.Seq.
+const subscriberBuffer = 256
+
+// types of updates broadcast by the hub, in addition
+// to the pattern edit commands. A pattern update means
+// the whole pattern was replaced, a bank update means
+// patterns were added, removed or reordered or the song
+// was changed, a switch update means a pattern will
+// play from the next bar, and a samples update means
+// samples were added to, removed from or renamed in
+// the sample pool.
+const (
+	updatePattern = "pattern"
+	updateBank    = "bank"
+	updateSwitch  = "switch"
+	updateTempo   = "tempo"
+	updateStart   = "start"
+	updateStop    = "stop"
+	updateSamples = "samples"
+)
+
+// Update describes a change to the sequencer's state that
+// is broadcast to every connected client.
+// Seq increases by one for every update, so clients can detect
+// when they have missed one.
+// Index and Swing are pointers so that track 0 and
+// a swing of 0 are sent.
+type Update struct {
+	Seq      uint64       `json:"seq"`
+	Type     string       `json:"type"`
+	Pattern  string       `json:"pattern,omitempty"`
+	Event    *Event       `json:"event,omitempty"`
+	Tempo    float32      `json:"tempo,omitempty"`
+	Patterns []string     `json:"patterns,omitempty"`
+	Song     []SongEntry  `json:"song,omitempty"`
+	Index    *int         `json:"index,omitempty"`
+	Track    *Track       `json:"track,omitempty"`
+	Swing    *float64     `json:"swing,omitempty"`
+	Groove   *Groove      `json:"groove,omitempty"`
+	Meter    *Meter       `json:"meter,omitempty"`
+	Loop     *Loop        `json:"loop,omitempty"`
+	Length   int          `json:"length,omitempty"`
+	Changes  []Change     `json:"changes,omitempty"`
+	Commands []*Command   `json:"commands,omitempty"`
+	Samples  []PoolChange `json:"samples,omitempty"`
+	// record is written to the session log when the
+	// update is published, along with events
+	record *logRecord
+	events []Event
+}
+
+func (self *Update) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(self)
+}
+
+// hub fans out sequencer updates to all subscribed clients
+type hub struct {
+	mu   sync.Mutex
+	seq  uint64
+	subs map[chan *Update]bool
+	// journal records the updates that are published,
+	// it is nil if there is no session log
+	journal *sessionLog
+}
+
+// subscribe returns a channel that will receive every
+// update published after subscribe returns
+func (self *hub) subscribe() chan *Update {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	c := make(chan *Update, subscriberBuffer)
+	self.subs[c] = true
+	return c
+}
+
+// unsubscribe stops sending updates to a channel returned by subscribe
+func (self *hub) unsubscribe(c chan *Update) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.subs, c)
+}
+
+// publish calls apply and, if it succeeds, broadcasts the update
+// it returns. Calls to publish are serialized so that every
+// subscriber sees updates in the order they were applied.
+func (self *hub) publish(apply func() (*Update, error)) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	up, err := apply()
+	if err != nil || up == nil {
+		return err
+	}
+	self.seq += 1
+	up.Seq = self.seq
+	if self.journal != nil && up.record != nil {
+		// the change has been applied, so it is broadcast
+		// even if it could not be logged
+		err = self.journal.append(up.Seq, up.record, up.events)
+		if err != nil {
+			log.Printf("could not write to session log: %s\n", err)
+		}
+	}
+	for c, _ := range self.subs {
+		select {
+		case c <- up:
+		default:
+			// slow subscriber, it will see a gap in Seq
+		}
+	}
+	return nil
+}
+
+// hold calls fn while no updates can be published, with
+// the Seq of the last update that was published
+func (self *hub) hold(fn func(seq uint64) error) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return fn(self.seq)
+}
+
+// newHub creates a hub with no subscribers
+func newHub() *hub {
+	return &hub{subs: make(map[chan *Update]bool)}
+}
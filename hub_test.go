@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestHubPublish(t *testing.T) {
+	h := newHub()
+	c1, c2 := h.subscribe(), h.subscribe()
+	for _, typ := range []string{"start", "tempo", "stop"} {
+		err := h.publish(func() (*Update, error) {
+			return &Update{Type: typ}, nil
+		})
+		assert.Equal(t, err, nil)
+	}
+	// every subscriber sees every update in the same order
+	for _, c := range []chan *Update{c1, c2} {
+		for i, typ := range []string{"start", "tempo", "stop"} {
+			up := <-c
+			assert.Equal(t, up.Seq, uint64(i+1))
+			assert.Equal(t, up.Type, typ)
+		}
+	}
+}
+
+func TestHubPublishError(t *testing.T) {
+	h := newHub()
+	c := h.subscribe()
+	err := h.publish(func() (*Update, error) {
+		return nil, errors.New("bad edit")
+	})
+	assert.Equal(t, err.Error(), "bad edit")
+	assert.Equal(t, len(c), 0)
+	h.publish(func() (*Update, error) {
+		return &Update{Type: "stop"}, nil
+	})
+	// failed edits do not use up a sequence number
+	assert.Equal(t, (<-c).Seq, uint64(1))
+}
+
+func TestHubUnsubscribe(t *testing.T) {
+	h := newHub()
+	c := h.subscribe()
+	h.unsubscribe(c)
+	h.publish(func() (*Update, error) {
+		return &Update{Type: "start"}, nil
+	})
+	assert.Equal(t, len(c), 0)
+}
+
+func TestHubSlowSubscriber(t *testing.T) {
+	h := newHub()
+	c := h.subscribe()
+	for i := 0; i < subscriberBuffer+1; i++ {
+		h.publish(func() (*Update, error) {
+			return &Update{Type: "tempo"}, nil
+		})
+	}
+	// the last update is dropped instead of blocking the hub
+	assert.Equal(t, len(c), subscriberBuffer)
+	for i := 0; i < subscriberBuffer; i++ {
+		<-c
+	}
+	h.publish(func() (*Update, error) {
+		return &Update{Type: "stop"}, nil
+	})
+	assert.Equal(t, (<-c).Seq, uint64(subscriberBuffer+2))
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+)
+
+const (
+	// importBatch is the number of imported events that are
+	// added to a pattern at a time
+	importBatch = 1024
+	// maxImport is the largest file that can be imported over http
+	maxImport = 64 << 20
+)
+
+// EventError is an event that could not be imported.
+// Index is the index of the event in the imported array.
+type EventError struct {
+	Index   int    `json:"index"`
+	Message string `json:"message"`
+}
+
+// ImportResult reports how many events were imported
+// and why the others were not. Skipped counts the notes
+// in a MIDI file that were not mapped to a sample.
+type ImportResult struct {
+	Imported int          `json:"imported"`
+	Skipped  int          `json:"skipped,omitempty"`
+	Errors   []EventError `json:"errors"`
+}
+
+// importEvents adds the notes in a JSON array of Events read
+// from r to the named pattern. The events are added as they are
+// read, importBatch at a time, so arrays of any size can be
+// imported, and each batch is undone in a single step. Events
+// that can not be read or added are reported in the result with
+// their index and the others are imported. Nothing is imported
+// if r does not hold a JSON array. Reading stops with an error if
+// r is an http.MaxBytesReader that reaches its limit, after the
+// events that were read before it are imported.
+func (self *server) importEvents(name string, r io.Reader) (*ImportResult, error) {
+	result := &ImportResult{Errors: make([]EventError, 0)}
+	batch, first := make([]Event, 0, importBatch), 0
+	var failed error
+	read := false
+	err := StreamEvents(r, func(index int, ev *Event, err error) error {
+		read = true
+		if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+			failed = self.addEvents(name, first, batch, result)
+			if failed == nil {
+				failed = err
+			}
+			return failed
+		}
+		if err == nil {
+			batch = append(batch, *ev)
+		}
+		if err != nil || len(batch) == importBatch {
+			// the errors are reported in the order of the events
+			failed = self.addEvents(name, first, batch, result)
+			first, batch = index+1, batch[:0]
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, EventError{index, err.Error()})
+		}
+		return failed
+	})
+	if failed != nil {
+		return nil, failed
+	}
+	if err != nil && !read {
+		return nil, err
+	}
+	failed = self.addEvents(name, first, batch, result)
+	if failed != nil {
+		return nil, failed
+	}
+	return result, nil
+}
+
+// addEvents adds the notes of events to the named pattern in a
+// single undo step and records the events that could not be added
+// in result. The index of the first event is first.
+func (self *server) addEvents(name string, first int, events []Event, result *ImportResult) error {
+	if len(events) == 0 {
+		return nil
+	}
+	return self.hub.publish(func() (*Update, error) {
+		name := self.patternName(name)
+		imported := make([]Event, 0, len(events))
+		err := self.seq.Batch(func() error {
+			for i, ev := range events {
+				err := errors.New("event has no note")
+				if ev.Note != nil {
+					err = self.seq.AddTo(name, ev.Pos, ev.Note)
+				}
+				if err != nil {
+					result.Errors = append(result.Errors, EventError{first + i, err.Error()})
+					continue
+				}
+				imported = append(imported, ev)
+			}
+			return nil
+		})
+		if err != nil || len(imported) == 0 {
+			return nil, err
+		}
+		result.Imported += len(imported)
+		rec := &logRecord{Type: recordImport, Pattern: name}
+		return &Update{Type: updatePattern, Pattern: name, record: rec, events: imported}, nil
+	})
+}
+
+// importMidi adds the notes in a standard MIDI file read from r
+// to the named pattern, quantized to the pattern's steps. Rules
+// map the MIDI notes to samples. The notes are added importBatch
+// at a time, see importEvents.
+func (self *server) importMidi(name string, r io.Reader, rules []MidiRule) (*ImportResult, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("midi import requires rules that map notes to samples")
+	}
+	meter, err := self.seq.Meter(name)
+	if err != nil {
+		return nil, err
+	}
+	mf, err := readMidi(r)
+	if err != nil {
+		return nil, err
+	}
+	events, skipped := mf.events(meter.stepsPerQuarter(), rules)
+	result := &ImportResult{Skipped: skipped, Errors: make([]EventError, 0)}
+	for first := 0; first < len(events); first += importBatch {
+		end := first + importBatch
+		if end > len(events) {
+			end = len(events)
+		}
+		err = self.addEvents(name, first, events[first:end], result)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// importFile imports the events in a JSON file into the
+// playing pattern and returns the result
+func (self *server) importFile(path string) (*ImportResult, error) {
+	file, eo := os.Open(path)
+	if eo != nil {
+		return nil, eo
+	}
+	defer file.Close()
+	return self.importEvents("", file)
+}
+
+// respondMidi responds with patterns as a standard MIDI file
+// that is downloaded as filename. The file is written before
+// anything is sent, so an error writing it can still be
+// responded to with an error status.
+func respondMidi(w http.ResponseWriter, filename string, patterns []*Pattern, tempo float32) error {
+	buf := new(bytes.Buffer)
+	err := writeMidi(buf, patterns, tempo)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "audio/midi")
+	disposition := mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+	w.Header().Set("Content-Disposition", disposition)
+	buf.WriteTo(w)
+	return nil
+}
+
+// midi returns an http handler that exports a pattern as a
+// standard MIDI file (GET) or imports a standard MIDI file into
+// a pattern (POST) and responds with an ImportResult.
+// The name query parameter selects the pattern, the playing
+// pattern is used if it is missing, and the map query parameter
+// of an import is a JSON array of MidiRules.
+func (self *server) midi() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		var result *ImportResult
+		name := r.URL.Query().Get("name")
+		status := http.StatusBadRequest
+		switch r.Method {
+		case "GET":
+			bank := self.seq.Bank()
+			pat := bank.find(name)
+			if pat == nil {
+				err = fmt.Errorf("pattern %s does not exist", name)
+				status = http.StatusNotFound
+				break
+			}
+			err = respondMidi(w, pat.Name+".mid", []*Pattern{pat}, bank.Tempo)
+			status = http.StatusInternalServerError
+		case "POST":
+			_, err = self.seq.Length(name)
+			if err != nil {
+				status = http.StatusNotFound
+				break
+			}
+			rules := make([]MidiRule, 0)
+			err = json.Unmarshal([]byte(r.URL.Query().Get("map")), &rules)
+			if err != nil {
+				err = errors.New("map must be a JSON array of rules: " + err.Error())
+				break
+			}
+			result, err = self.importMidi(name, http.MaxBytesReader(w, r.Body, maxImport), rules)
+			if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+				status = http.StatusRequestEntityTooLarge
+			}
+			if err != nil {
+				break
+			}
+			err = respondJSON(w, http.StatusOK, result)
+			status = http.StatusInternalServerError
+		default:
+			err = errors.New("method not allowed")
+			status = http.StatusMethodNotAllowed
+		}
+		if err != nil {
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
+
+// songMidi returns an http handler that exports the song
+// arrangement as a standard MIDI file (GET)
+func (self *server) songMidi() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		status := http.StatusInternalServerError
+		bank := self.seq.Bank()
+		if r.Method != "GET" {
+			err = errors.New("method not allowed")
+			status = http.StatusMethodNotAllowed
+		} else if len(bank.Song) == 0 {
+			err = errors.New("there is no song")
+			status = http.StatusNotFound
+		} else {
+			err = respondMidi(w, "song.mid", bank.arrangement(), bank.Tempo)
+		}
+		if err != nil {
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
+
+// events returns an http handler that imports a JSON array
+// of Events (POST) into a pattern and responds with an
+// ImportResult. The name query parameter selects the pattern,
+// the playing pattern is used if it is missing.
+func (self *server) events() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		var result *ImportResult
+		name := r.URL.Query().Get("name")
+		status := http.StatusBadRequest
+		if r.Method != "POST" {
+			err = errors.New("method not allowed")
+			status = http.StatusMethodNotAllowed
+		} else if _, err = self.seq.Length(name); err != nil {
+			status = http.StatusNotFound
+		} else if result, err = self.importEvents(name, http.MaxBytesReader(w, r.Body, maxImport)); err == nil {
+			err = respondJSON(w, http.StatusOK, result)
+			status = http.StatusInternalServerError
+		} else if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		if err != nil {
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
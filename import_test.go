@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadEvents(t *testing.T) {
+	file, err := os.Open("test_pattern.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	events, err := ReadEvents(file)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(events), 8)
+	assert.Equal(t, events[1].Note.Sample, "blip.wav")
+}
+
+func TestStreamEvents(t *testing.T) {
+	count := 0
+	body := `[{"pos":1,"note":{"sample":"kick","number":60,"velocity":100}},{"pos":2}]`
+	err := StreamEvents(strings.NewReader(body), func(index int, ev *Event, err error) error {
+		assert.Equal(t, err, nil)
+		assert.Equal(t, index, count)
+		count += 1
+		return nil
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, count, 2)
+
+	err = StreamEvents(strings.NewReader(`{"pos":1}`), func(int, *Event, error) error { return nil })
+	assert.Equal(t, err.Error(), "events must be a JSON array")
+
+	// reading goes on after an event of the wrong type
+	failed := make([]int, 0)
+	read := func(index int, ev *Event, err error) error {
+		if err != nil {
+			assert.Equal(t, ev == nil, true)
+			failed = append(failed, index)
+		}
+		return nil
+	}
+	err = StreamEvents(strings.NewReader(`[{"pos":1},{"pos":"a"},{"pos":3}]`), read)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, failed, []int{1})
+	// but stops after malformed JSON
+	failed = failed[:0]
+	err = StreamEvents(strings.NewReader(`[{"pos":1},{"pos":}]`), read)
+	assert.Equal(t, strings.HasPrefix(err.Error(), "event 1: "), true)
+	assert.Equal(t, failed, []int{1})
+	failed = failed[:0]
+	err = StreamEvents(strings.NewReader(`[{"pos":1},`), read)
+	assert.Equal(t, err.Error(), "event 1: unexpected end of JSON input")
+	assert.Equal(t, failed, []int{1})
+}
+
+func TestServerImportEvents(t *testing.T) {
+	srv := newTestServer(t)
+	handler := srv.events()
+	updates := srv.hub.subscribe()
+
+	body := `[
+		{"pos":1,"note":{"sample":"kick","number":60,"velocity":100}},
+		{"pos":16,"note":{"sample":"kick","number":60,"velocity":100}},
+		{"pos":3},
+		{"pos":5,"note":{"sample":"snare","number":60,"velocity":100}}
+	]`
+	req, _ := http.NewRequest("POST", "/pattern/events", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Body.String(), `{"imported":2,"errors":[`+
+		`{"index":1,"message":"pos (16) greater than pattern length (16)"},`+
+		`{"index":2,"message":"event has no note"}]}`+"\n")
+	assert.Equal(t, (<-updates).Type, "pattern")
+	assert.Equal(t, countEvents(t, srv.seq), 2)
+	// the import is undone in one step
+	srv.seq.Undo()
+	assert.Equal(t, countEvents(t, srv.seq), 0)
+
+	// malformed events are reported with the others
+	body = `[
+		{"pos":"1","note":{"sample":"kick","number":60,"velocity":100}},
+		{"pos":2,"note":{"sample":"kick","number":60,"velocity":100}},`
+	req, _ = http.NewRequest("POST", "/pattern/events", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, w.Code, http.StatusOK)
+	result := new(ImportResult)
+	json.Unmarshal(w.Body.Bytes(), result)
+	assert.Equal(t, result.Imported, 1)
+	assert.Equal(t, len(result.Errors), 2)
+	assert.Equal(t, result.Errors[0].Index, 0)
+	assert.Equal(t, result.Errors[1], EventError{2, "unexpected end of JSON input"})
+	assert.Equal(t, countEvents(t, srv.seq), 1)
+	srv.seq.Undo()
+
+	req, _ = http.NewRequest("POST", "/pattern/events", strings.NewReader(`{"pos":1}`))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+
+	req, _ = http.NewRequest("POST", "/pattern/events?name=verse", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, w.Code, http.StatusNotFound)
+
+	req, _ = http.NewRequest("GET", "/pattern/events", nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, w.Code, http.StatusMethodNotAllowed)
+}
+
+func TestServerImportLarge(t *testing.T) {
+	srv := newTestServer(t)
+	srv.seq.CreatePattern("long", 4096)
+	handler := srv.events()
+	updates := srv.hub.subscribe()
+
+	// large imports are added in batches
+	body := new(bytes.Buffer)
+	body.WriteString("[")
+	for i := 0; i < importBatch+10; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(body, `{"pos":%d,"note":{"sample":"kick","number":60,"velocity":100}}`, i)
+	}
+	body.WriteString("]")
+	req, _ := http.NewRequest("POST", "/pattern/events?name=long", body)
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Body.String(), fmt.Sprintf(`{"imported":%d,"errors":[]}`+"\n", importBatch+10))
+	assert.Equal(t, (<-updates).Type, "pattern")
+	assert.Equal(t, (<-updates).Type, "pattern")
+	// each batch is undone in one step
+	srv.seq.Undo()
+	events, _ := srv.seq.Events("long")
+	assert.Equal(t, len(events), importBatch)
+
+	req, _ = http.NewRequest("POST", "/pattern/events", strings.NewReader("["+strings.Repeat(" ", maxImport)+"]"))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, w.Code, http.StatusRequestEntityTooLarge)
+}
+
+func TestServerImportFile(t *testing.T) {
+	srv := newTestServer(t)
+	result, err := srv.importFile("test_pattern.json")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, result.Imported, 8)
+	assert.Equal(t, len(result.Errors), 0)
+}
@@ -0,0 +1,115 @@
+package main
+
+// historyLimit is the number of edits that can be undone
+const historyLimit = 1000
+
+// Change is the notes at a position in a pattern after an
+// edit was made, undone or redone. Clients replace the notes
+// they display at Pos with Notes.
+type Change struct {
+	Pattern string  `json:"pattern"`
+	Pos     uint64  `json:"pos"`
+	Notes   []*Note `json:"notes"`
+}
+
+// journalEntry records the notes at a position in a pattern
+// before and after an edit, so the edit can be undone by
+// restoring before and redone by restoring after
+type journalEntry struct {
+	pattern string
+	pos     uint64
+	before  []*Note
+	after   []*Note
+}
+
+// journal is the undo and redo history of pattern edits.
+// Every step in the history is a group of entries that are
+// undone and redone together.
+type journal struct {
+	undo [][]journalEntry
+	redo [][]journalEntry
+	// group collects the entries of a bulk edit,
+	// it is nil when no bulk edit is in progress
+	group []journalEntry
+}
+
+// record adds an edit to the history. Making a new edit
+// means the edits that were undone can not be redone.
+func (self *journal) record(entry journalEntry) {
+	self.recordAll([]journalEntry{entry})
+}
+
+// recordAll adds the edits of a bulk edit to the history
+// as one step
+func (self *journal) recordAll(entries []journalEntry) {
+	if self.group != nil {
+		self.group = append(self.group, entries...)
+		return
+	}
+	if len(entries) > 0 {
+		self.push(entries)
+	}
+}
+
+// push adds a step to the history, forgetting the oldest
+// step if the history is full
+func (self *journal) push(step []journalEntry) {
+	self.undo = append(self.undo, step)
+	if len(self.undo) > historyLimit {
+		self.undo = self.undo[1:]
+	}
+	self.redo = nil
+}
+
+// begin starts grouping the edits that are recorded into one step
+func (self *journal) begin() {
+	self.group = make([]journalEntry, 0)
+}
+
+// end adds the grouped edits to the history as one step
+func (self *journal) end() {
+	group := self.group
+	self.group = nil
+	if len(group) > 0 {
+		self.push(group)
+	}
+}
+
+// cancel stops grouping edits and returns the edits that
+// were grouped, without adding them to the history
+func (self *journal) cancel() []journalEntry {
+	group := self.group
+	self.group = nil
+	return group
+}
+
+// forget removes the steps that edited the named pattern,
+// which can not be undone or redone once the pattern has
+// been resized, had its tracks renumbered or been deleted
+func (self *journal) forget(pattern string) {
+	self.undo = forget(self.undo, pattern)
+	self.redo = forget(self.redo, pattern)
+}
+
+func forget(steps [][]journalEntry, pattern string) [][]journalEntry {
+	kept := make([][]journalEntry, 0, len(steps))
+	for _, step := range steps {
+		touched := false
+		for _, entry := range step {
+			touched = touched || entry.pattern == pattern
+		}
+		if !touched {
+			kept = append(kept, step)
+		}
+	}
+	return kept
+}
+
+// snapshot returns a copy of the notes at pos, since notes
+// are edited in place
+func snapshot(pat *Pattern, pos uint64) []*Note {
+	if pos >= uint64(pat.Length) {
+		return nil
+	}
+	return append([]*Note(nil), pat.Notes[pos]...)
+}
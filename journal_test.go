@@ -0,0 +1,111 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+// countEvents returns the number of notes in the playing pattern
+func countEvents(t *testing.T, seq *sequencer) int {
+	events, err := seq.Events("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(events)
+}
+
+func TestSequencerUndo(t *testing.T) {
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 16, 120)
+	kick, snare := NewNote("kick", 60, 100), NewNote("snare", 60, 100)
+	seq.AddTo("", 0, kick)
+	seq.AddTo("", 0, snare)
+	seq.Clear("", 0)
+	// failed edits are not recorded
+	assert.NotEqual(t, seq.AddTo("", 16, kick), nil)
+
+	changes, err := seq.Undo()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, changes, []Change{{"main", 0, []*Note{kick, snare}}})
+	assert.Equal(t, seq.NotesAt("", 0), []*Note{kick, snare})
+	seq.Undo()
+	assert.Equal(t, seq.NotesAt("", 0), []*Note{kick})
+	seq.Undo()
+	assert.Equal(t, len(seq.NotesAt("", 0)), 0)
+	_, err = seq.Undo()
+	assert.Equal(t, err.Error(), "nothing to undo")
+
+	changes, err = seq.Redo()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, changes, []Change{{"main", 0, []*Note{kick}}})
+	// a new edit can not be redone over
+	seq.AddTo("", 4, snare)
+	_, err = seq.Redo()
+	assert.Equal(t, err.Error(), "nothing to redo")
+}
+
+func TestSequencerBatch(t *testing.T) {
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 16, 120)
+	kick := NewNote("kick", 60, 100)
+	err := seq.Batch(func() error {
+		seq.AddTo("", 0, kick)
+		seq.AddTo("", 8, kick)
+		return nil
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, countEvents(t, seq), 2)
+
+	// a batch that fails is reverted
+	err = seq.Batch(func() error {
+		seq.Clear("", 0)
+		return seq.AddTo("", 16, kick)
+	})
+	assert.NotEqual(t, err, nil)
+	assert.Equal(t, seq.NotesAt("", 0), []*Note{kick})
+
+	changes, _ := seq.Undo()
+	assert.Equal(t, len(changes), 2)
+	assert.Equal(t, countEvents(t, seq), 0)
+
+	// replacing every note is a single step
+	seq.SetEvents("", []Event{{2, kick}, {3, kick}})
+	seq.Undo()
+	assert.Equal(t, countEvents(t, seq), 0)
+	seq.Redo()
+	assert.Equal(t, countEvents(t, seq), 2)
+
+	// resizing a pattern forgets its history
+	seq.Resize("", 8)
+	_, err = seq.Undo()
+	assert.Equal(t, err.Error(), "nothing to undo")
+}
+
+func TestCommandExecuteUndo(t *testing.T) {
+	srv := newTestServer(t)
+	updates := srv.hub.subscribe()
+	kick := NewNote("kick", 60, 100)
+
+	res := srv.execute(&Command{ID: "1", Command: "batch", Commands: []*Command{
+		{Command: "add", Event: &Event{0, kick}},
+		{Command: "add", Event: &Event{4, kick}},
+	}})
+	assert.Equal(t, res, Response{"1", "ok", "batch", ""})
+	assert.Equal(t, len((<-updates).Commands), 2)
+
+	res = srv.execute(&Command{ID: "2", Command: "undo"})
+	assert.Equal(t, res, Response{"2", "ok", "undo", ""})
+	update := <-updates
+	assert.Equal(t, len(update.Changes), 2)
+	assert.Equal(t, len(update.Changes[0].Notes), 0)
+
+	res = srv.execute(&Command{ID: "3", Command: "batch", Commands: []*Command{
+		{Command: "add", Event: &Event{0, kick}},
+		{Command: "undo"},
+	}})
+	assert.Equal(t, res, Response{"3", "error", "batch command 1: undo can not be batched", codeInvalid})
+	assert.Equal(t, len(srv.seq.NotesAt("", 0)), 0)
+
+	res = srv.execute(&Command{ID: "4", Command: "redo"})
+	assert.Equal(t, res, Response{"4", "ok", "redo", ""})
+	assert.Equal(t, len((<-updates).Changes), 2)
+	assert.Equal(t, len(srv.seq.NotesAt("", 4)), 1)
+}
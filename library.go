@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SampleInfo describes a sample in the pool. Name is the path of
+// the sample file relative to the sample directory without its
+// extension, e.g. pack/kicks/kick, and Folder is the directory
+// part of Name. Duration is in seconds. The duration, channels,
+// rate and bits are read from the file's header, and are 0 if the
+// header could not be read. Region is set if the sample is
+// a region of another sample.
+type SampleInfo struct {
+	Name     string   `json:"name"`
+	Folder   string   `json:"folder,omitempty"`
+	Format   string   `json:"format"`
+	Duration float64  `json:"duration"`
+	Channels int      `json:"channels"`
+	Rate     int      `json:"rate"`
+	Bits     int      `json:"bits"`
+	Tags     []string `json:"tags"`
+	Region   *Region  `json:"region,omitempty"`
+}
+
+// sampleInfos sorts samples by name
+type sampleInfos []SampleInfo
+
+func (self sampleInfos) Len() int {
+	return len(self)
+}
+
+func (self sampleInfos) Less(i, j int) bool {
+	return self[i].Name < self[j].Name
+}
+
+func (self sampleInfos) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+// sampleFormat returns the format of a sample file, which
+// is the name of its extension with aif spelled as aiff
+func sampleFormat(f string) string {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(f), "."))
+	if ext == "aif" {
+		return "aiff"
+	}
+	return ext
+}
+
+// readSampleInfo reads the format, duration, channels, rate
+// and bits of a sample file from its header
+func readSampleInfo(f string) (SampleInfo, error) {
+	info := SampleInfo{Format: sampleFormat(f), Tags: []string{}}
+	file, eo := os.Open(f)
+	if eo != nil {
+		return info, eo
+	}
+	defer file.Close()
+	var err error
+	switch info.Format {
+	case "wav":
+		err = readWavInfo(file, &info)
+	case "flac":
+		err = readFlacInfo(file, &info)
+	case "aiff":
+		err = readAiffInfo(file, &info)
+	default:
+		err = fmt.Errorf("%s files are not supported", info.Format)
+	}
+	return info, err
+}
+
+// readWavInfo reads the fmt chunk of a WAV file and
+// the size of its data chunk
+func readWavInfo(r io.ReadSeeker, info *SampleInfo) error {
+	le := binary.LittleEndian
+	header := make([]byte, 12)
+	_, er := io.ReadFull(r, header)
+	if er != nil || string(header[:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return errors.New("not a wav file")
+	}
+	align := 0
+	for {
+		_, er = io.ReadFull(r, header[:8])
+		if er != nil {
+			return errors.New("wav file has no data chunk")
+		}
+		id, size := string(header[:4]), int64(le.Uint32(header[4:8]))
+		// chunks are padded to an even size
+		skip := size + size%2
+		switch id {
+		case "fmt ":
+			if size < 16 {
+				return errors.New("wav fmt chunk is too short")
+			}
+			chunk := make([]byte, 16)
+			_, er = io.ReadFull(r, chunk)
+			if er != nil {
+				return er
+			}
+			info.Channels, info.Rate = int(le.Uint16(chunk[2:])), int(le.Uint32(chunk[4:]))
+			align, info.Bits = int(le.Uint16(chunk[12:])), int(le.Uint16(chunk[14:]))
+			skip -= 16
+		case "data":
+			if align == 0 || info.Rate == 0 {
+				return errors.New("wav data chunk before fmt chunk")
+			}
+			info.Duration = float64(size/int64(align)) / float64(info.Rate)
+			return nil
+		}
+		_, es := r.Seek(skip, io.SeekCurrent)
+		if es != nil {
+			return es
+		}
+	}
+}
+
+// readFlacInfo reads the STREAMINFO block of a FLAC file,
+// which is always its first metadata block
+func readFlacInfo(r io.Reader, info *SampleInfo) error {
+	header := make([]byte, 8+34)
+	_, er := io.ReadFull(r, header)
+	if er != nil || string(header[:4]) != "fLaC" || header[4]&0x7F != 0 {
+		return errors.New("not a flac file")
+	}
+	b := header[8:]
+	info.Rate = int(b[10])<<12 | int(b[11])<<4 | int(b[12])>>4
+	info.Channels = int(b[12]>>1&0x07) + 1
+	info.Bits = int(b[12]&0x01)<<4 | int(b[13])>>4 + 1
+	frames := uint64(b[13]&0x0F)<<32 | uint64(binary.BigEndian.Uint32(b[14:]))
+	if info.Rate > 0 {
+		info.Duration = float64(frames) / float64(info.Rate)
+	}
+	return nil
+}
+
+// readAiffInfo reads the COMM chunk of an AIFF or AIFF-C file
+func readAiffInfo(r io.ReadSeeker, info *SampleInfo) error {
+	be := binary.BigEndian
+	header := make([]byte, 12)
+	_, er := io.ReadFull(r, header)
+	form := string(header[8:12])
+	if er != nil || string(header[:4]) != "FORM" || (form != "AIFF" && form != "AIFC") {
+		return errors.New("not an aiff file")
+	}
+	for {
+		_, er = io.ReadFull(r, header[:8])
+		if er != nil {
+			return errors.New("aiff file has no COMM chunk")
+		}
+		size := int64(be.Uint32(header[4:8]))
+		if string(header[:4]) != "COMM" {
+			// chunks are padded to an even size
+			_, es := r.Seek(size+size%2, io.SeekCurrent)
+			if es != nil {
+				return es
+			}
+			continue
+		}
+		if size < 18 {
+			return errors.New("aiff COMM chunk is too short")
+		}
+		chunk := make([]byte, 18)
+		_, er = io.ReadFull(r, chunk)
+		if er != nil {
+			return er
+		}
+		info.Channels, info.Bits = int(be.Uint16(chunk)), int(be.Uint16(chunk[6:]))
+		frames := be.Uint32(chunk[2:])
+		// the rate is an 80 bit extended precision float
+		exp := int(be.Uint16(chunk[8:])&0x7FFF) - 16383 - 63
+		rate := math.Ldexp(float64(be.Uint64(chunk[10:])), exp)
+		info.Rate = int(rate + 0.5)
+		if rate > 0 {
+			info.Duration = float64(frames) / rate
+		}
+		return nil
+	}
+}
+
+// sampleFilter selects samples from the pool. Search matches
+// samples with a name or a tag that contains it, ignoring case.
+// Folder matches the samples in a folder and its subfolders.
+// Empty fields match every sample.
+type sampleFilter struct {
+	Search string
+	Tags   []string
+	Folder string
+	Format string
+}
+
+// matches returns true if a sample passes the filter
+func (self *sampleFilter) matches(info *SampleInfo) bool {
+	if self.Format != "" && sampleFormat("."+self.Format) != info.Format {
+		return false
+	}
+	folder := strings.Trim(self.Folder, "/")
+	if folder != "" && info.Folder != folder && !strings.HasPrefix(info.Folder, folder+"/") {
+		return false
+	}
+	for _, tag := range self.Tags {
+		if !hasTag(info.Tags, normalizeTag(tag)) {
+			return false
+		}
+	}
+	if self.Search == "" {
+		return true
+	}
+	search := strings.ToLower(self.Search)
+	if strings.Contains(strings.ToLower(info.Name), search) {
+		return true
+	}
+	for _, tag := range info.Tags {
+		if strings.Contains(tag, search) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTag returns true if tags contains tag
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeTag returns a tag in lower case without
+// surrounding spaces
+func normalizeTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// info returns the SampleInfo of the sample with a name
+func (self *samples) info(name string) (SampleInfo, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	file, exists := self.files[name]
+	if !exists {
+		return SampleInfo{}, false
+	}
+	return self.tagged(file), true
+}
+
+// tagged returns the SampleInfo of a file with its tags.
+// The caller must hold mu.
+func (self *samples) tagged(file *sampleFile) SampleInfo {
+	info := file.info
+	info.Tags = self.tags[info.Name]
+	if info.Tags == nil {
+		info.Tags = []string{}
+	}
+	return info
+}
+
+// find returns the samples that pass a filter, sorted by name
+func (self *samples) find(filter *sampleFilter) []SampleInfo {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	infos := make(sampleInfos, 0)
+	for _, file := range self.files {
+		info := self.tagged(file)
+		if filter.matches(&info) {
+			infos = append(infos, info)
+		}
+	}
+	sort.Sort(infos)
+	return infos
+}
+
+// readTags reads the tags of the samples from a JSON file, which
+// the tags are saved to when they change. It is not an error if
+// the file does not exist.
+func (self *samples) readTags(f string) error {
+	tags := make(map[string][]string)
+	bs, er := ioutil.ReadFile(f)
+	if er != nil && !os.IsNotExist(er) {
+		return er
+	}
+	if er == nil {
+		ed := json.Unmarshal(bs, &tags)
+		if ed != nil {
+			return ed
+		}
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.tags, self.tagsPath = tags, f
+	return nil
+}
+
+// SetTags replaces the tags of a sample. Tags are stored in lower
+// case without duplicates, and saved to the tags file if there is one.
+func (self *samples) SetTags(name string, tags []string) (SampleInfo, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	file, exists := self.files[name]
+	if !exists {
+		return SampleInfo{}, fmt.Errorf("sample %s does not exist", name)
+	}
+	set := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = normalizeTag(tag)
+		if tag == "" {
+			return SampleInfo{}, errors.New("tags can not be empty")
+		}
+		if !hasTag(set, tag) {
+			set = append(set, tag)
+		}
+	}
+	sort.Strings(set)
+	if len(set) == 0 {
+		delete(self.tags, name)
+	} else {
+		self.tags[name] = set
+	}
+	info := file.info
+	info.Tags = set
+	return info, self.saveTags()
+}
+
+// saveTags writes the tags to the tags file, if there is one.
+// The caller must hold mu.
+func (self *samples) saveTags() error {
+	if self.tagsPath == "" {
+		return nil
+	}
+	bs, em := json.MarshalIndent(self.tags, "", "    ")
+	if em != nil {
+		return em
+	}
+	return writeAtomic(self.tagsPath, append(bs, '\n'))
+}
+
+// list returns an http handler that lists the samples (GET) as
+// a JSON array of SampleInfos. The q, tag, folder and format query
+// parameters filter the samples as the fields of a sampleFilter,
+// tag can be repeated to select samples that have every tag.
+func (self *samples) list() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		status := http.StatusInternalServerError
+		if r.Method != "GET" {
+			err = errors.New("method not allowed")
+			status = http.StatusMethodNotAllowed
+		} else {
+			query := r.URL.Query()
+			filter := &sampleFilter{query.Get("q"), query["tag"], query.Get("folder"), query.Get("format")}
+			err = respondJSON(w, http.StatusOK, self.find(filter))
+		}
+		if err != nil {
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
+
+// tagSample returns an http handler that replaces the tags of a
+// sample (PUT) with a JSON array of tags and responds with the
+// sample's SampleInfo. The name query parameter selects the sample.
+func (self *samples) tagSample() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		var info SampleInfo
+		status := http.StatusBadRequest
+		tags := make([]string, 0)
+		name := r.URL.Query().Get("name")
+		if r.Method != "PUT" {
+			err = errors.New("method not allowed")
+			status = http.StatusMethodNotAllowed
+		} else if _, exists := self.lookup(name); !exists {
+			err = fmt.Errorf("sample %s does not exist", name)
+			status = http.StatusNotFound
+		} else if err = json.NewDecoder(r.Body).Decode(&tags); err == nil {
+			info, err = self.SetTags(name, tags)
+			if err == nil {
+				err = respondJSON(w, http.StatusOK, info)
+				status = http.StatusInternalServerError
+			}
+		}
+		if err != nil {
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
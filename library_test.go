@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// flacHeader returns the start of a FLAC file with a STREAMINFO block
+func flacHeader(rate, channels, bits int, frames uint64) []byte {
+	info := make([]byte, 34)
+	info[10], info[11] = byte(rate>>12), byte(rate>>4)
+	info[12] = byte(rate<<4) | byte(channels-1)<<1 | byte((bits-1)>>4)
+	info[13] = byte((bits-1)<<4) | byte(frames>>32&0x0F)
+	binary.BigEndian.PutUint32(info[14:], uint32(frames))
+	return append([]byte{'f', 'L', 'a', 'C', 0x80, 0, 0, 34}, info...)
+}
+
+// aiffFile returns an AIFF file with a COMM chunk for a
+// rate that is a power of two times an integer below 2^16
+func aiffFile(rate, channels, bits int, frames uint32) []byte {
+	comm := make([]byte, 18)
+	binary.BigEndian.PutUint16(comm, uint16(channels))
+	binary.BigEndian.PutUint32(comm[2:], frames)
+	binary.BigEndian.PutUint16(comm[6:], uint16(bits))
+	exp := 0
+	for rate>>uint(exp+1) > 0 {
+		exp += 1
+	}
+	binary.BigEndian.PutUint16(comm[8:], uint16(16383+exp))
+	binary.BigEndian.PutUint64(comm[10:], uint64(rate)<<uint(63-exp))
+	form := append([]byte("AIFF"), midiChunk("NAME", []byte("kick"))...)
+	form = append(form, midiChunk("COMM", comm)...)
+	return midiChunk("FORM", form)
+}
+
+func TestReadSampleInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wav := new(bytes.Buffer)
+	writeWav(wav, &audioBuffer{44100, make([][2]float32, 22050)})
+	files := map[string][]byte{
+		"kick.wav":   wav.Bytes(),
+		"snare.flac": flacHeader(48000, 1, 24, 96000),
+		"hat.aif":    aiffFile(22050, 2, 16, 11025),
+		"tom.wav":    []byte("not a wav file"),
+	}
+	for name, bs := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), bs, 0644)
+	}
+
+	info, err := readSampleInfo(filepath.Join(dir, "kick.wav"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, info, SampleInfo{Format: "wav", Duration: 0.5, Channels: 2, Rate: 44100, Bits: 16, Tags: []string{}})
+	info, err = readSampleInfo(filepath.Join(dir, "snare.flac"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, info, SampleInfo{Format: "flac", Duration: 2, Channels: 1, Rate: 48000, Bits: 24, Tags: []string{}})
+	info, err = readSampleInfo(filepath.Join(dir, "hat.aif"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, info, SampleInfo{Format: "aiff", Duration: 0.5, Channels: 2, Rate: 22050, Bits: 16, Tags: []string{}})
+	info, err = readSampleInfo(filepath.Join(dir, "tom.wav"))
+	assert.Equal(t, err.Error(), "not a wav file")
+	assert.Equal(t, info.Format, "wav")
+}
+
+func TestSampleLibrary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wav := new(bytes.Buffer)
+	writeWav(wav, &audioBuffer{44100, make([][2]float32, 4410)})
+	for _, name := range []string{"kick.wav", "808/kicks/kick.wav", "808/snare.wav", "909/kick.wav", ".git/kick.wav"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), wav.Bytes(), 0644)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "909/hat.flac"), flacHeader(44100, 2, 16, 44100), 0644)
+	tagsPath := filepath.Join(dir, "tags.json")
+	smp := newSamples(newNullEngine())
+	err = smp.readTags(tagsPath)
+	assert.Equal(t, err, nil)
+	err = smp.readSamples(dir)
+	assert.Equal(t, err, nil)
+
+	names := func(infos []SampleInfo) []string {
+		names := make([]string, len(infos))
+		for i, info := range infos {
+			names[i] = info.Name
+		}
+		return names
+	}
+	all := smp.find(new(sampleFilter))
+	assert.Equal(t, names(all), []string{"808/kicks/kick", "808/snare", "909/hat", "909/kick", "kick"})
+	assert.Equal(t, all[0].Folder, "808/kicks")
+	assert.Equal(t, all[4].Folder, "")
+	path, _ := smp.lookup("808/kicks/kick")
+	assert.Equal(t, path, filepath.Join(dir, "808", "kicks", "kick.wav"))
+
+	assert.Equal(t, names(smp.find(&sampleFilter{Folder: "808"})), []string{"808/kicks/kick", "808/snare"})
+	assert.Equal(t, names(smp.find(&sampleFilter{Format: "flac"})), []string{"909/hat"})
+	assert.Equal(t, names(smp.find(&sampleFilter{Search: "KICK", Folder: "909/"})), []string{"909/kick"})
+
+	info, err := smp.SetTags("909/kick", []string{"Punchy", "acoustic ", "punchy"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, info.Tags, []string{"acoustic", "punchy"})
+	_, err = smp.SetTags("909/clap", []string{"dry"})
+	assert.Equal(t, err.Error(), "sample 909/clap does not exist")
+	_, err = smp.SetTags("909/kick", []string{"punchy", " "})
+	assert.Equal(t, err.Error(), "tags can not be empty")
+	assert.Equal(t, names(smp.find(&sampleFilter{Tags: []string{"punchy"}})), []string{"909/kick"})
+	assert.Equal(t, names(smp.find(&sampleFilter{Search: "acou"})), []string{"909/kick"})
+
+	// tags follow a renamed sample and are saved
+	os.Rename(filepath.Join(dir, "909/kick.wav"), filepath.Join(dir, "909/kick2.wav"))
+	changes, err := smp.rescan()
+	assert.Equal(t, changes, []PoolChange{{poolRename, "909/kick2", "909/kick"}})
+	loaded := newSamples(nil)
+	err = loaded.readTags(tagsPath)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, loaded.tags, map[string][]string{"909/kick2": {"acoustic", "punchy"}})
+}
+
+func TestSampleLibraryHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "808"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "808/kick.flac"), flacHeader(44100, 2, 16, 22050), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "snare.flac"), flacHeader(44100, 2, 16, 22050), 0644)
+	smp := newSamples(newNullEngine())
+	err = smp.readSamples(dir)
+	assert.Equal(t, err, nil)
+
+	w := httptest.NewRecorder()
+	smp.tagSample()(w, httptest.NewRequest("PUT", "/samples/tags?name=808/kick", strings.NewReader(`["deep"]`)))
+	assert.Equal(t, w.Code, http.StatusOK)
+	w = httptest.NewRecorder()
+	smp.tagSample()(w, httptest.NewRequest("PUT", "/samples/tags?name=clap", strings.NewReader(`["deep"]`)))
+	assert.Equal(t, w.Code, http.StatusNotFound)
+	w = httptest.NewRecorder()
+	smp.tagSample()(w, httptest.NewRequest("PUT", "/samples/tags?name=snare", strings.NewReader(`"deep"`)))
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+
+	w = httptest.NewRecorder()
+	smp.list()(w, httptest.NewRequest("GET", "/samples?tag=deep", nil))
+	assert.Equal(t, w.Code, http.StatusOK)
+	infos := make([]SampleInfo, 0)
+	err = json.Unmarshal(w.Body.Bytes(), &infos)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, infos, []SampleInfo{{"808/kick", "808", "flac", 0.5, 2, 44100, 16, []string{"deep"}, nil}})
+	w = httptest.NewRecorder()
+	smp.list()(w, httptest.NewRequest("GET", "/samples?q=sn", nil))
+	assert.Equal(t, strings.TrimSpace(w.Body.String()),
+		`[{"name":"snare","format":"flac","duration":0.5,"channels":2,"rate":44100,"bits":16,"tags":[]}]`)
+}
@@ -3,9 +3,14 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"os/signal"
 	"path"
+	"syscall"
+	"time"
 )
 
 const (
@@ -20,14 +25,128 @@ const (
 	DefaultCh2 = "system:playback_2"
 )
 
+// midiCommand converts a standard MIDI file into a JSON array
+// of Events that can be imported with -import or POST /pattern/events
+func midiCommand(args []string) error {
+	flags := flag.NewFlagSet("midi", flag.ExitOnError)
+	rulesPath := flags.String("map", "", "JSON file of rules that map MIDI notes to samples")
+	steps := flags.Float64("steps", 4, "steps per quarter note the notes are quantized to")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: lightningd midi -map rules.json [-steps 4] file.mid")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *rulesPath == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	bs, er := ioutil.ReadFile(*rulesPath)
+	if er != nil {
+		return er
+	}
+	rules := make([]MidiRule, 0)
+	ed := json.Unmarshal(bs, &rules)
+	if ed != nil {
+		return ed
+	}
+	file, eo := os.Open(flags.Arg(0))
+	if eo != nil {
+		return eo
+	}
+	defer file.Close()
+	mf, er := readMidi(file)
+	if er != nil {
+		return er
+	}
+	events, skipped := mf.events(*steps, rules)
+	if skipped > 0 {
+		log.Printf("skipped %d notes that are not mapped to a sample\n", skipped)
+	}
+	return json.NewEncoder(os.Stdout).Encode(events)
+}
+
+// renderCommand renders a pattern or the song in a project
+// file to a WAV file
+func renderCommand(args []string) error {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	proj := flags.String("project", "", "project file to render")
+	name := flags.String("pattern", "", "pattern to render (defaults to the playing pattern)")
+	song := flags.Bool("song", false, "render the song instead of a pattern")
+	tempo := flags.Float64("tempo", 0, "tempo in bpm (defaults to the project's tempo)")
+	rate := flags.Int("rate", defaultRate, "sample rate")
+	dir := flags.String("samples", path.Join(DefaultWWW, "assets", "audio"), "sample directory")
+	out := flags.String("o", "", "WAV file to write")
+	flags.Parse(args)
+	if *proj == "" || *out == "" {
+		fmt.Fprintln(os.Stderr, "usage: lightningd render -project file -o out.wav [flags]")
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	bank, er := readBank(*proj)
+	if er != nil {
+		return er
+	}
+	if bank.Tempo == 0 {
+		bank.Tempo = 120
+	}
+	smp := newSamples(nil)
+	er = smp.readSamples(*dir)
+	if er != nil {
+		return er
+	}
+	req := &RenderRequest{*name, *song, float32(*tempo), *rate}
+	md, er := renderBank(bank, req, smp.paths())
+	if er != nil {
+		return er
+	}
+	for _, name := range md.skipped {
+		fmt.Fprintf(os.Stderr, "skipped sample %s, only wav samples can be rendered\n", name)
+	}
+	file, eo := os.Create(*out)
+	if eo != nil {
+		return eo
+	}
+	ew := md.writeWav(file)
+	ec := file.Close()
+	if ew != nil {
+		return ew
+	}
+	return ec
+}
+
 func main() {
+	// subcommands that do not start the daemon
+	commands := map[string]func([]string) error{
+		"midi":   midiCommand,
+		"render": renderCommand,
+	}
+	if len(os.Args) > 1 && commands[os.Args[1]] != nil {
+		err := commands[os.Args[1]](os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	bind := flag.String("bind", DefaultAddr, "bind address")
 	www := flag.String("www", DefaultWWW, "web root")
 	ch1 := flag.String("ch1", DefaultCh1, "left channel JACK sink")
 	ch2 := flag.String("ch2", DefaultCh2, "right channel JACK sink")
+	engineName := flag.String("engine", "jack", "audio engine, jack or null (records notes without playing them)")
+	proj := flag.String("project", "", "project file the patterns are loaded from and saved to")
+	autosave := flag.Duration("autosave", 0, "autosave interval for the project file (0 disables autosave)")
+	journal := flag.String("journal", "", "session log that changes are recorded to and recovered from (requires -project)")
+	compact := flag.Duration("compact", time.Minute, "interval the session log is compacted into the project file at, if autosave is disabled")
+	importPath := flag.String("import", "", "JSON file of events to import into the playing pattern")
+	tags := flag.String("tags", "", "JSON file the tags of the samples are read from and saved to")
+	watch := flag.Duration("watch", 30*time.Second, "interval the sample directory is polled at if it can not be watched for changes (0 disables polling)")
+	shutdown := flag.Duration("shutdown", 5*time.Second, "time to wait for connections to close on SIGINT or SIGTERM")
 	// parse cli flags
 	flag.Parse()
-	server, err := newServer(*www)
+	eng, err := newEngine(*engineName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server, err := newServer(*www, eng, newMetroClock())
 	if err != nil {
 		log.Fatal("could not create server: " + err.Error())
 	}
@@ -38,16 +157,53 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *tags != "" {
+		err = server.samples.readTags(*tags)
+		if err != nil {
+			log.Fatal("could not read tags: " + err.Error())
+		}
+	}
+	server.watch(*watch)
+	if *proj != "" {
+		log.Printf("loading project %s\n", *proj)
+		err = server.openProject(*proj, *autosave)
+		if err != nil {
+			log.Fatal("could not load project: " + err.Error())
+		}
+	}
+	if *journal != "" {
+		log.Printf("recovering session from %s\n", *journal)
+		err = server.openJournal(*journal, *compact)
+		if err != nil {
+			log.Fatal("could not recover session: " + err.Error())
+		}
+	}
+	if *importPath != "" {
+		result, err := server.importFile(*importPath)
+		if err != nil {
+			log.Fatal("could not import events: " + err.Error())
+		}
+		for _, ee := range result.Errors {
+			log.Printf("could not import event %d: %s\n", ee.Index, ee.Message)
+		}
+		log.Printf("imported %d events from %s\n", result.Imported, *importPath)
+	}
 	server.connect(*ch1, *ch2)
-	server.listen(*bind)
-	// setup a pattern from a chunk of json
-	pat := NewPattern(0)
-	content, err := ioutil.ReadFile("pat.json")
-	if err != nil {
-		log.Fatal("could not read pat.json")
+	listening := make(chan error, 1)
+	go func() {
+		listening <- server.listen(*bind)
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err = <-listening:
+		server.close()
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Printf("received %s, shutting down\n", sig)
 	}
-	err = json.Unmarshal(content, &pat)
+	err = server.shutdown(*shutdown)
 	if err != nil {
-		log.Fatal("could not parse pat.json")
+		log.Fatal("could not shut down cleanly: " + err.Error())
 	}
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Loop is a region of a pattern that plays over and over,
+// from Start up to but not including End.
+type Loop struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// validate returns an error if the loop does not fit in a
+// pattern of the given length
+func (self *Loop) validate(length int) error {
+	if self.Start >= self.End {
+		return fmt.Errorf("loop start (%d) must be before loop end (%d)", self.Start, self.End)
+	}
+	if self.End > uint64(length) {
+		return fmt.Errorf("loop end (%d) greater than pattern length (%d)", self.End, length)
+	}
+	return nil
+}
+
+// SetLoop sets the region of the pattern that is looped.
+// A nil loop plays the whole pattern.
+func (self *Pattern) SetLoop(loop *Loop) error {
+	if loop != nil {
+		err := loop.validate(self.Length)
+		if err != nil {
+			return err
+		}
+	}
+	self.Loop = loop
+	return nil
+}
+
+// start returns the first position the pattern plays
+func (self *Pattern) start() uint64 {
+	if self.Loop == nil {
+		return 0
+	}
+	return self.Loop.Start
+}
+
+// Resize changes the length of the pattern. Growing a pattern
+// adds empty positions to the end, truncating it removes the
+// notes past the new end. A loop that ends past the new end
+// is shortened, or removed if it starts past the new end.
+func (self *Pattern) Resize(length int) error {
+	err := validLength(length)
+	if err != nil {
+		return err
+	}
+	notes := make([][]*Note, length)
+	copy(notes, self.Notes)
+	self.Notes, self.Length = notes, length
+	if loop := self.Loop; loop != nil && loop.End > uint64(length) {
+		self.Loop = nil
+		if loop.Start < uint64(length) {
+			self.Loop = &Loop{loop.Start, uint64(length)}
+		}
+	}
+	return nil
+}
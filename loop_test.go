@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+func TestPatternResize(t *testing.T) {
+	pat := NewPattern(16)
+	pat.AddTo(3, NewNote("kick", 60, 100))
+	pat.AddTo(12, NewNote("snare", 60, 100))
+	pat.SetLoop(&Loop{8, 16})
+
+	err := pat.Resize(0)
+	assert.Equal(t, err.Error(), "pattern length (0) must be positive")
+	err = pat.Resize(maxPatternLength + 1)
+	assert.Equal(t, err.Error(), "pattern length (65537) can not be greater than 65536")
+	assert.Equal(t, len(pat.Notes), 16)
+
+	err = pat.Resize(10)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(pat.Notes), 10)
+	assert.Equal(t, len(pat.Events()), 1)
+	assert.Equal(t, pat.Loop, &Loop{8, 10})
+
+	// growing the pattern again does not bring back its notes
+	err = pat.Resize(32)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(pat.Events()), 1)
+	assert.Equal(t, len(pat.NotesAt(12)), 0)
+	assert.Equal(t, pat.AddTo(31, NewNote("kick", 60, 100)), nil)
+
+	pat.Resize(8)
+	assert.Equal(t, pat.Loop, (*Loop)(nil))
+}
+
+func TestPatternSetLoop(t *testing.T) {
+	pat := NewPattern(16)
+	err := pat.SetLoop(&Loop{4, 4})
+	assert.Equal(t, err.Error(), "loop start (4) must be before loop end (4)")
+	err = pat.SetLoop(&Loop{4, 17})
+	assert.Equal(t, err.Error(), "loop end (17) greater than pattern length (16)")
+	err = pat.SetLoop(&Loop{4, 16})
+	assert.Equal(t, err, nil)
+}
+
+func TestSequencerLoop(t *testing.T) {
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 16, 120)
+	err := seq.SetLoop("", &Loop{4, 8})
+	assert.Equal(t, err, nil)
+	// positions before the loop jump to its start
+	steps(t, seq, 1)
+	assert.Equal(t, seq.pos, uint64(4))
+	steps(t, seq, 4)
+	assert.Equal(t, seq.pos, uint64(4))
+
+	// the song does not move on while a pattern loops
+	seq.CreatePattern("verse", 16)
+	seq.SetSong([]SongEntry{{"main", 1}, {"verse", 1}})
+	steps(t, seq, 4)
+	assert.Equal(t, seq.Playing(), "main")
+	steps(t, seq, 20)
+	assert.Equal(t, seq.Playing(), "main")
+	seq.SetLoop("", nil)
+	steps(t, seq, 12)
+	assert.Equal(t, seq.Playing(), "verse")
+
+	// truncating the playing pattern moves back to its start
+	steps(t, seq, 12)
+	err = seq.Resize("", 8)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, seq.pos, uint64(0))
+	assert.Equal(t, seq.Resize("chorus", 8).Error(), "pattern chorus does not exist")
+}
+
+func TestCommandExecuteLoop(t *testing.T) {
+	srv := newTestServer(t)
+	updates := srv.hub.subscribe()
+
+	res := srv.execute(&Command{ID: "1", Command: "loop", Loop: &Loop{4, 8}})
+	assert.Equal(t, res, Response{"1", "ok", "loop", ""})
+	assert.Equal(t, (<-updates).Loop, &Loop{4, 8})
+
+	res = srv.execute(&Command{ID: "2", Command: "pattern.resize", Length: 32})
+	assert.Equal(t, res, Response{"2", "ok", "pattern.resize", ""})
+	assert.Equal(t, (<-updates).Length, 32)
+	assert.Equal(t, srv.seq.Bank().Patterns[0].Length, 32)
+
+	res = srv.execute(&Command{ID: "3", Command: "loop", Loop: &Loop{4, 40}})
+	assert.Equal(t, res, Response{"3", "error", "loop end (40) greater than pattern length (32)", codeInvalid})
+	res = srv.execute(&Command{ID: "4", Command: "loop"})
+	assert.Equal(t, res, Response{"4", "ok", "loop", ""})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+)
+
+// metroSteps is the number of ticks a Metro emits per beat
+// (it ticks in sixteenth notes)
+const metroSteps = 4
+
+// defaultMeter is the meter of patterns that do not declare one:
+// 4/4 in sixteenth notes
+var defaultMeter = Meter{4, 4, 4}
+
+// Meter is the time signature of a pattern, along with the
+// number of steps each beat is divided into.
+// For example 3/4 in eighth note triplets is {3, 4, 6}.
+type Meter struct {
+	Beats int `json:"beats"`
+	Unit  int `json:"unit"`
+	Steps int `json:"steps"`
+}
+
+// validate returns an error if the meter can not be played
+func (self *Meter) validate() error {
+	if self.Beats <= 0 {
+		return fmt.Errorf("beats per bar (%d) must be positive", self.Beats)
+	}
+	if self.Unit <= 0 || self.Unit&(self.Unit-1) != 0 {
+		return fmt.Errorf("beat unit (%d) must be a power of 2", self.Unit)
+	}
+	if self.Steps <= 0 {
+		return fmt.Errorf("steps per beat (%d) must be positive", self.Steps)
+	}
+	return nil
+}
+
+// BarLength returns the number of steps in a bar
+func (self Meter) BarLength() int {
+	return self.Beats * self.Steps
+}
+
+// stepsPerQuarter returns the number of steps in a quarter note
+func (self Meter) stepsPerQuarter() float64 {
+	return float64(self.Steps) * float64(self.Unit) / 4
+}
+
+// Location is a position in a pattern in musical terms.
+// Bar, Beat and Step count from 1.
+type Location struct {
+	Pattern string `json:"pattern"`
+	Pos     uint64 `json:"pos"`
+	Bar     int    `json:"bar"`
+	Beat    int    `json:"beat"`
+	Step    int    `json:"step"`
+}
+
+// meter returns the pattern's meter
+func (self *Pattern) meter() Meter {
+	if self.Meter == nil {
+		return defaultMeter
+	}
+	return *self.Meter
+}
+
+// SetMeter sets the pattern's meter. A nil meter
+// sets the pattern back to the default meter.
+func (self *Pattern) SetMeter(meter *Meter) error {
+	if meter != nil {
+		err := meter.validate()
+		if err != nil {
+			return err
+		}
+	}
+	self.Meter = meter
+	return nil
+}
+
+// Locate returns the bar, beat and step of pos in the pattern
+func (self *Pattern) Locate(pos uint64) Location {
+	meter := self.meter()
+	bar := int(pos) / meter.BarLength()
+	offset := int(pos) % meter.BarLength()
+	return Location{
+		Pattern: self.Name,
+		Pos:     pos,
+		Bar:     bar + 1,
+		Beat:    offset/meter.Steps + 1,
+		Step:    offset%meter.Steps + 1,
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"testing"
+	"time"
+)
+
+func TestPatternLocate(t *testing.T) {
+	pat := NewPattern(64)
+	pat.Name = "main"
+	assert.Equal(t, pat.Locate(0), Location{"main", 0, 1, 1, 1})
+	assert.Equal(t, pat.Locate(21), Location{"main", 21, 2, 2, 2})
+
+	// 3/4 in eighth note triplets has 18 steps in a bar
+	err := pat.SetMeter(&Meter{3, 4, 6})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, pat.Locate(17), Location{"main", 17, 1, 3, 6})
+	assert.Equal(t, pat.Locate(25), Location{"main", 25, 2, 2, 2})
+}
+
+func TestPatternSetMeter(t *testing.T) {
+	pat := NewPattern(16)
+	err := pat.SetMeter(&Meter{0, 4, 4})
+	assert.Equal(t, err.Error(), "beats per bar (0) must be positive")
+	err = pat.SetMeter(&Meter{3, 3, 4})
+	assert.Equal(t, err.Error(), "beat unit (3) must be a power of 2")
+	err = pat.SetMeter(&Meter{3, 8, 0})
+	assert.Equal(t, err.Error(), "steps per beat (0) must be positive")
+	assert.Equal(t, pat.meter(), defaultMeter)
+
+	pat.SetMeter(&Meter{7, 8, 2})
+	assert.Equal(t, pat.meter().BarLength(), 14)
+	pat.SetMeter(nil)
+	assert.Equal(t, pat.meter(), defaultMeter)
+}
+
+func TestSequencerMeter(t *testing.T) {
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 36, 120)
+	assert.Equal(t, seq.metroTempo(), float32(120))
+	assert.Equal(t, seq.stepDuration(), 125*time.Millisecond)
+
+	err := seq.SetMeter("", &Meter{3, 4, 6})
+	assert.Equal(t, err, nil)
+	// six steps per beat ticks the metro at one and a half
+	// times the tempo of sixteenths
+	assert.Equal(t, seq.metroTempo(), float32(180))
+	assert.Equal(t, seq.stepDuration(), time.Second/12)
+
+	err = seq.CreatePattern("verse", 16)
+	assert.Equal(t, err, nil)
+	steps(t, seq, 5)
+	err = seq.SwitchPattern("verse")
+	assert.Equal(t, err, nil)
+	// the switch waits for the end of the bar of 18 steps
+	steps(t, seq, 13)
+	assert.Equal(t, seq.Position(), Location{"main", 17, 1, 3, 6})
+	assert.Equal(t, seq.Playing(), "verse")
+	assert.Equal(t, seq.metroTempo(), float32(120))
+	steps(t, seq, 6)
+	assert.Equal(t, seq.Position(), Location{"verse", 5, 1, 2, 2})
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"sort"
+)
+
+// midiDivision is the number of ticks per quarter note in
+// the standard MIDI files that lightningd writes
+const midiDivision = 480
+
+// MidiRule maps MIDI notes to a sample. Channel is a MIDI channel
+// from 1 to 16, 0 matches every channel. Notes from Low to High
+// match the rule, a High of 0 matches every note from Low up.
+// Number is the note number the sample plays at, 0 plays it at
+// its recorded pitch (rootNote), since MIDI note numbers of drum
+// maps pick a sound rather than a pitch.
+type MidiRule struct {
+	Channel int    `json:"channel,omitempty"`
+	Low     int32  `json:"low,omitempty"`
+	High    int32  `json:"high,omitempty"`
+	Sample  string `json:"sample"`
+	Number  int32  `json:"number,omitempty"`
+}
+
+// matches returns true if the rule maps a note on channel to its sample
+func (self *MidiRule) matches(channel int, number int32) bool {
+	high := self.High
+	if high == 0 {
+		high = 127
+	}
+	return (self.Channel == 0 || self.Channel == channel+1) &&
+		number >= self.Low && number <= high
+}
+
+// midiNote is a note read from a standard MIDI file.
+// Start and End are in ticks.
+type midiNote struct {
+	channel  int
+	number   int32
+	velocity int32
+	start    uint64
+	end      uint64
+}
+
+// midiFile is the notes of a standard MIDI file
+type midiFile struct {
+	// division is the number of ticks per quarter note
+	division int
+	notes    []midiNote
+}
+
+// readMidi reads the notes of every track in a type 0 or
+// type 1 standard MIDI file
+func readMidi(r io.Reader) (*midiFile, error) {
+	bs, er := ioutil.ReadAll(r)
+	if er != nil {
+		return nil, er
+	}
+	mf := new(midiFile)
+	header := false
+	for len(bs) > 0 {
+		if len(bs) < 8 {
+			return nil, errors.New("midi file ends in the middle of a chunk")
+		}
+		id, size := string(bs[:4]), binary.BigEndian.Uint32(bs[4:8])
+		if uint64(size) > uint64(len(bs)-8) {
+			return nil, fmt.Errorf("midi %s chunk is longer than the file", id)
+		}
+		chunk := bs[8 : 8+size]
+		bs = bs[8+size:]
+		switch {
+		case id == "MThd":
+			if len(chunk) < 6 {
+				return nil, errors.New("midi header is too short")
+			}
+			format := binary.BigEndian.Uint16(chunk)
+			division := binary.BigEndian.Uint16(chunk[4:])
+			if format > 1 {
+				return nil, fmt.Errorf("midi file format %d is not supported", format)
+			}
+			if division&0x8000 != 0 || division == 0 {
+				return nil, errors.New("midi files with SMPTE time division are not supported")
+			}
+			mf.division = int(division)
+			header = true
+		case id == "MTrk" && header:
+			notes, et := readMidiTrack(chunk)
+			if et != nil {
+				return nil, et
+			}
+			mf.notes = append(mf.notes, notes...)
+		case !header:
+			return nil, errors.New("not a standard midi file")
+		}
+		// other chunks are ignored, as the spec asks
+	}
+	if !header {
+		return nil, errors.New("not a standard midi file")
+	}
+	return mf, nil
+}
+
+// readMidiTrack returns the notes in a track chunk. Notes
+// that are never turned off end at the end of the track.
+func readMidiTrack(bs []byte) ([]midiNote, error) {
+	truncated := errors.New("midi track ends in the middle of an event")
+	notes := make([]midiNote, 0)
+	// playing holds the indices of the notes that have not been
+	// turned off, by channel and note number
+	playing := make(map[[2]int][]int)
+	tick, status := uint64(0), byte(0)
+	for len(bs) > 0 {
+		delta, n := readVarLen(bs)
+		if n == 0 || n == len(bs) {
+			return nil, truncated
+		}
+		tick += uint64(delta)
+		bs = bs[n:]
+		switch b := bs[0]; {
+		case b == 0xFF:
+			// meta event
+			if len(bs) < 2 {
+				return nil, truncated
+			}
+			size, n := readVarLen(bs[2:])
+			if n == 0 || uint64(size) > uint64(len(bs)-2-n) {
+				return nil, truncated
+			}
+			bs = bs[2+n+int(size):]
+		case b == 0xF0 || b == 0xF7:
+			// sysex events cancel running status
+			size, n := readVarLen(bs[1:])
+			if n == 0 || uint64(size) > uint64(len(bs)-1-n) {
+				return nil, truncated
+			}
+			bs = bs[1+n+int(size):]
+			status = 0
+		default:
+			if b&0x80 != 0 {
+				status = b
+				bs = bs[1:]
+			} else if status == 0 {
+				return nil, errors.New("midi track uses running status before a status byte")
+			}
+			size := 2
+			if kind := status & 0xF0; kind == 0xC0 || kind == 0xD0 {
+				size = 1
+			}
+			if len(bs) < size {
+				return nil, truncated
+			}
+			channel, number := int(status&0x0F), int32(bs[0])
+			velocity := int32(bs[size-1])
+			bs = bs[size:]
+			key := [2]int{channel, int(number)}
+			switch status & 0xF0 {
+			case 0x90:
+				if velocity > 0 {
+					playing[key] = append(playing[key], len(notes))
+					notes = append(notes, midiNote{channel, number, velocity, tick, tick})
+					continue
+				}
+				// a note on with velocity 0 is a note off
+				fallthrough
+			case 0x80:
+				if on := playing[key]; len(on) > 0 {
+					notes[on[0]].end = tick
+					playing[key] = on[1:]
+				}
+			}
+		}
+	}
+	for _, on := range playing {
+		for _, i := range on {
+			notes[i].end = tick
+		}
+	}
+	return notes, nil
+}
+
+// readVarLen reads a variable length quantity and returns
+// it with the number of bytes it took, which is 0 if bs ends
+// before the quantity does
+func readVarLen(bs []byte) (uint32, int) {
+	value := uint32(0)
+	for i := 0; i < len(bs) && i < 4; i++ {
+		value = value<<7 | uint32(bs[i]&0x7F)
+		if bs[i]&0x80 == 0 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// events quantizes the notes to a grid of steps per quarter
+// note and maps them to samples with rules. The first rule that
+// matches a note sets its sample and number, notes that do not
+// match any rule are left out and counted in skipped.
+func (self *midiFile) events(steps float64, rules []MidiRule) ([]Event, int) {
+	events, skipped := make([]Event, 0, len(self.notes)), 0
+	toSteps := func(ticks uint64) uint64 {
+		return uint64(math.Floor(float64(ticks)*steps/float64(self.division) + 0.5))
+	}
+	for _, mn := range self.notes {
+		sample, number := "", int32(rootNote)
+		for i := range rules {
+			if rules[i].matches(mn.channel, mn.number) {
+				sample = rules[i].Sample
+				if rules[i].Number != 0 {
+					number = rules[i].Number
+				}
+				break
+			}
+		}
+		if sample == "" {
+			skipped += 1
+			continue
+		}
+		note := NewNote(sample, number, mn.velocity)
+		pos := toSteps(mn.start)
+		note.Duration = int(toSteps(mn.end) - pos)
+		if note.Duration < 1 {
+			note.Duration = 1
+		}
+		events = append(events, Event{pos, note})
+	}
+	return events, skipped
+}
+
+// midiEvent is an event in a track of a standard MIDI file
+type midiEvent struct {
+	tick uint64
+	data []byte
+}
+
+// midiEvents sorts events by tick, with note offs before the
+// other events at the same tick so a note that is played again
+// as it ends is not cut off
+type midiEvents []midiEvent
+
+func (self midiEvents) Len() int {
+	return len(self)
+}
+
+func (self midiEvents) Less(i, j int) bool {
+	if self[i].tick != self[j].tick {
+		return self[i].tick < self[j].tick
+	}
+	return self[i].data[0]&0xF0 == 0x80 && self[j].data[0]&0xF0 != 0x80
+}
+
+func (self midiEvents) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+// writeMidi writes patterns, played one after the other at tempo,
+// as a type 1 standard MIDI file. The first track holds the tempo
+// and time signatures, and the notes of each sample are written
+// to a track named after the sample. Notes are mixed with the
+// settings of their pattern's tracks and groove.
+func writeMidi(w io.Writer, patterns []*Pattern, tempo float32) error {
+	if tempo <= 0 {
+		return fmt.Errorf("tempo (%g) must be positive", tempo)
+	}
+	conductor := make(midiEvents, 0)
+	samples, tracks := make([]string, 0), make(map[string]midiEvents)
+	channels := make(map[string]byte)
+	start := 0.0
+	var meter Meter
+	for i, pat := range patterns {
+		if i == 0 || pat.meter() != meter {
+			meter = pat.meter()
+			conductor = append(conductor, midiMeter(uint64(start+0.5), meter, tempo)...)
+		}
+		perStep := midiDivision / meter.stepsPerQuarter()
+		for pos, notes := range pat.Notes {
+			delay, scale := pat.feel(uint64(pos))
+			on := uint64(start + (float64(pos)+delay)*perStep + 0.5)
+			for _, note := range pat.mix(notes) {
+				velocity := scaleVelocity(note.Velocity, scale)
+				if velocity <= 0 {
+					continue
+				}
+				duration := note.Duration
+				if duration < 1 {
+					duration = 1
+				}
+				off := uint64(start + float64(pos+duration)*perStep + 0.5)
+				channel, exists := channels[note.Sample]
+				if !exists {
+					channel = byte(len(samples) % 16)
+					channels[note.Sample] = channel
+					samples = append(samples, note.Sample)
+				}
+				number := byte(math.Max(0, math.Min(127, float64(note.Number))))
+				tracks[note.Sample] = append(tracks[note.Sample],
+					midiEvent{on, []byte{0x90 | channel, number, byte(velocity)}},
+					midiEvent{off, []byte{0x80 | channel, number, 0}})
+			}
+		}
+		start += float64(pat.Length) * perStep
+	}
+	header := make([]byte, 6)
+	binary.BigEndian.PutUint16(header, 1)
+	binary.BigEndian.PutUint16(header[2:], uint16(1+len(samples)))
+	binary.BigEndian.PutUint16(header[4:], midiDivision)
+	buf := bytes.NewBuffer(midiChunk("MThd", header))
+	buf.Write(midiChunk("MTrk", midiTrack("", conductor)))
+	for _, sample := range samples {
+		buf.Write(midiChunk("MTrk", midiTrack(sample, tracks[sample])))
+	}
+	_, ew := buf.WriteTo(w)
+	return ew
+}
+
+// midiMeter returns the time signature and tempo meta events
+// for a pattern with meter that starts at tick
+func midiMeter(tick uint64, meter Meter, tempo float32) midiEvents {
+	// tempo is in beats of the meter's unit, and MIDI
+	// tempos are in microseconds per quarter note
+	micros := math.Min(0xFFFFFF, 60e6*float64(meter.Unit)/(4*float64(tempo)))
+	mpq := uint32(micros + 0.5)
+	unit := byte(0)
+	for u := meter.Unit; u > 1; u >>= 1 {
+		unit += 1
+	}
+	return midiEvents{
+		{tick, []byte{0xFF, 0x58, 0x04, byte(meter.Beats), unit, 24, 8}},
+		{tick, []byte{0xFF, 0x51, 0x03, byte(mpq >> 16), byte(mpq >> 8), byte(mpq)}},
+	}
+}
+
+// midiTrack returns the data of a track chunk that holds events,
+// named name if name is not empty
+func midiTrack(name string, events midiEvents) []byte {
+	sort.Stable(events)
+	buf, tick := new(bytes.Buffer), uint64(0)
+	if name != "" {
+		buf.Write([]byte{0x00, 0xFF, 0x03})
+		writeVarLen(buf, uint32(len(name)))
+		buf.WriteString(name)
+	}
+	for _, ev := range events {
+		writeVarLen(buf, uint32(ev.tick-tick))
+		buf.Write(ev.data)
+		tick = ev.tick
+	}
+	buf.Write([]byte{0x00, 0xFF, 0x2F, 0x00})
+	return buf.Bytes()
+}
+
+// midiChunk returns a chunk of a standard MIDI file
+func midiChunk(id string, data []byte) []byte {
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(data)))
+	return append(append([]byte(id), size...), data...)
+}
+
+// writeVarLen writes a variable length quantity
+func writeVarLen(buf *bytes.Buffer, value uint32) {
+	bs := []byte{byte(value & 0x7F)}
+	for value >>= 7; value > 0; value >>= 7 {
+		bs = append([]byte{byte(value&0x7F) | 0x80}, bs...)
+	}
+	buf.Write(bs)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// testMidi is a type 1 file with 96 ticks per quarter note
+var testMidi = append(midiChunk("MThd", []byte{0, 1, 0, 1, 0, 96}), midiChunk("MTrk", []byte{
+	0x00, 0xFF, 0x51, 0x03, 0x07, 0xA1, 0x20, // tempo
+	0x00, 0x90, 0x24, 0x64, // kick on at 0
+	0x30, 0x80, 0x24, 0x00, // kick off at 48
+	0x18, 0x99, 0x26, 0x50, // snare on channel 10 at 72
+	0x00, 0x26, 0x00, // running status note on with velocity 0
+	0x81, 0x00, 0x90, 0x2A, 0x40, // hat on at 200, never turned off
+	0x10, 0xFF, 0x2F, 0x00, // end of track at 216
+})...)
+
+func TestReadMidi(t *testing.T) {
+	mf, err := readMidi(bytes.NewReader(testMidi))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, mf.division, 96)
+	assert.Equal(t, mf.notes, []midiNote{
+		{0, 36, 100, 0, 48},
+		{9, 38, 80, 72, 72},
+		{0, 42, 64, 200, 216},
+	})
+
+	_, err = readMidi(bytes.NewReader(midiChunk("MThd", []byte{0, 2, 0, 1, 0, 96})))
+	assert.Equal(t, err.Error(), "midi file format 2 is not supported")
+	_, err = readMidi(bytes.NewReader(midiChunk("MThd", []byte{0, 0, 0, 1, 0xE7, 0x28})))
+	assert.Equal(t, err.Error(), "midi files with SMPTE time division are not supported")
+	_, err = readMidi(bytes.NewReader(testMidi[:len(testMidi)-6]))
+	assert.Equal(t, err.Error(), "midi MTrk chunk is longer than the file")
+	_, err = readMidi(bytes.NewReader(midiChunk("RIFF", nil)))
+	assert.Equal(t, err.Error(), "not a standard midi file")
+}
+
+func TestMidiEvents(t *testing.T) {
+	mf, _ := readMidi(bytes.NewReader(testMidi))
+	rules := []MidiRule{
+		{Channel: 10, Sample: "snare"},
+		{Low: 36, High: 36, Sample: "kick", Number: 48},
+	}
+	events, skipped := mf.events(4, rules)
+	assert.Equal(t, skipped, 1)
+	assert.Equal(t, len(events), 2)
+	assert.Equal(t, events[0].Pos, uint64(0))
+	assert.Equal(t, events[0].Note.Sample, "kick")
+	assert.Equal(t, events[0].Note.Number, int32(48))
+	assert.Equal(t, events[0].Note.Duration, 2)
+	assert.Equal(t, events[1].Pos, uint64(3))
+	assert.Equal(t, events[1].Note.Sample, "snare")
+	assert.Equal(t, events[1].Note.Velocity, int32(80))
+	// notes play at the recorded pitch of their sample by default
+	assert.Equal(t, events[1].Note.Number, int32(rootNote))
+	assert.Equal(t, events[1].Note.Duration, 1)
+
+	// eighth note triplets quantize to six steps per quarter
+	events, _ = mf.events(6, append(rules, MidiRule{Sample: "hat"}))
+	assert.Equal(t, events[1].Pos, uint64(5))
+	assert.Equal(t, events[2].Pos, uint64(13))
+}
+
+func TestServerImportMidi(t *testing.T) {
+	srv := newTestServer(t)
+	handler := srv.midi()
+
+	query := url.Values{"map": {`[{"sample":"drums"}]`}}
+	req, _ := http.NewRequest("POST", "/pattern/midi?"+query.Encode(), bytes.NewReader(testMidi))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Body.String(), `{"imported":3,"errors":[]}`+"\n")
+	assert.Equal(t, len(srv.seq.NotesAt("", 8)), 1)
+	assert.Equal(t, srv.seq.NotesAt("", 8)[0].Number, int32(rootNote))
+
+	req, _ = http.NewRequest("POST", "/pattern/midi", bytes.NewReader(testMidi))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+}
+
+func TestWriteMidi(t *testing.T) {
+	pat := NewPattern(8)
+	pat.AddTo(0, NewNote("kick", 36, 100))
+	snare := NewNote("snare", 38, 90)
+	snare.Duration = 2
+	pat.AddTo(4, snare)
+	pat.AddTo(6, NewNote("kick", 36, 0))
+
+	buf := new(bytes.Buffer)
+	err := writeMidi(buf, []*Pattern{pat, pat}, 120)
+	assert.Equal(t, err, nil)
+	// 500000 microseconds per quarter note is 120 bpm
+	assert.Equal(t, bytes.Contains(buf.Bytes(), []byte{0xFF, 0x51, 0x03, 0x07, 0xA1, 0x20}), true)
+	assert.Equal(t, bytes.Contains(buf.Bytes(), []byte{0xFF, 0x03, 0x05, 's', 'n', 'a', 'r', 'e'}), true)
+	// a track per sample after the tempo track
+	assert.Equal(t, bytes.Count(buf.Bytes(), []byte("MTrk")), 3)
+
+	mf, err := readMidi(buf)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, mf.division, 480)
+	// silent notes are left out
+	assert.Equal(t, mf.notes, []midiNote{
+		{0, 36, 100, 0, 120},
+		{0, 36, 100, 960, 1080},
+		{1, 38, 90, 480, 720},
+		{1, 38, 90, 1440, 1680},
+	})
+
+	// a beat of 3/8 is an eighth note, so two steps per
+	// beat are still sixteenths
+	pat.SetMeter(&Meter{3, 8, 2})
+	buf.Reset()
+	writeMidi(buf, []*Pattern{pat}, 120)
+	assert.Equal(t, bytes.Contains(buf.Bytes(), []byte{0xFF, 0x58, 0x04, 3, 3, 24, 8, 0x00, 0xFF, 0x51, 0x03, 0x0F, 0x42, 0x40}), true)
+	mf, _ = readMidi(buf)
+	assert.Equal(t, mf.notes[1], midiNote{1, 38, 90, 480, 720})
+}
+
+func TestServerExportMidi(t *testing.T) {
+	srv := newTestServer(t)
+	srv.seq.AddTo("", 0, NewNote("kick", 36, 100))
+
+	req, _ := http.NewRequest("GET", "/pattern/midi", nil)
+	w := httptest.NewRecorder()
+	srv.midi()(w, req)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Content-Type"), "audio/midi")
+	mf, err := readMidi(w.Body)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(mf.notes), 1)
+	assert.Equal(t, w.Header().Get("Content-Disposition"), "attachment; filename=main.mid")
+
+	// file names are quoted
+	srv.seq.CreatePattern("verse 1", 16)
+	req, _ = http.NewRequest("GET", "/pattern/midi?"+url.Values{"name": {"verse 1"}}.Encode(), nil)
+	w = httptest.NewRecorder()
+	srv.midi()(w, req)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Content-Disposition"), `attachment; filename="verse 1.mid"`)
+
+	req, _ = http.NewRequest("GET", "/song/midi", nil)
+	w = httptest.NewRecorder()
+	srv.songMidi()(w, req)
+	assert.Equal(t, w.Code, http.StatusNotFound)
+
+	srv.seq.SetSong([]SongEntry{{"main", 3}})
+	w = httptest.NewRecorder()
+	srv.songMidi()(w, req)
+	assert.Equal(t, w.Code, http.StatusOK)
+	mf, _ = readMidi(w.Body)
+	assert.Equal(t, len(mf.notes), 3)
+	assert.Equal(t, mf.notes[2].start, uint64(2*16*120))
+}
@@ -2,17 +2,40 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/lightning/lightning"
 	"io"
 )
 
+// Note is a note in a Pattern. Track is the index of the
+// pattern Track the note belongs to. Duration is the number
+// of steps the note plays for before it is stopped, notes
+// without a duration play until their sample ends. Notes are
+// only stopped by engines that can stop them, see noteStopper.
+type Note struct {
+	lightning.Note
+	Track    int `json:"track,omitempty"`
+	Duration int `json:"duration,omitempty"`
+}
+
+// NewNote creates a Note on the first track of a pattern
+func NewNote(sample string, number, velocity int32) *Note {
+	return &Note{Note: *lightning.NewNote(sample, number, velocity)}
+}
+
 // Pattern defines a pattern of notes.
 // Notes that you add to a pattern at a position will overwrite
 // any notes at that position with the same number.
 type Pattern struct {
-	Length int                 `json:"length"`
-	Notes  [][]*lightning.Note `json:"notes"`
+	Name   string    `json:"name,omitempty"`
+	Length int       `json:"length"`
+	Notes  [][]*Note `json:"notes"`
+	Tracks []*Track  `json:"tracks,omitempty"`
+	Swing  float64   `json:"swing,omitempty"`
+	Groove *Groove   `json:"groove,omitempty"`
+	Meter  *Meter    `json:"meter,omitempty"`
+	Loop   *Loop     `json:"loop,omitempty"`
 }
 
 func (self *Pattern) indexTooLarge(pos uint64) error {
@@ -20,27 +43,50 @@ func (self *Pattern) indexTooLarge(pos uint64) error {
 	return fmt.Errorf(str, pos, self.Length)
 }
 
+// uses returns true if the pattern plays a sample, or has a
+// track that plays it by default
+func (self *Pattern) uses(sample string) bool {
+	for _, track := range self.Tracks {
+		if track.Sample == sample {
+			return true
+		}
+	}
+	for _, notes := range self.Notes {
+		for _, note := range notes {
+			if note != nil && note.Sample == sample {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // NotesAt returns a slice representing the notes
 // that are stored at a particular position in a pattern.
 // pos modulo the size of the pattern is the actual index into
 // the pattern.
-func (self *Pattern) NotesAt(pos uint64) []*lightning.Note {
+func (self *Pattern) NotesAt(pos uint64) []*Note {
 	notes := len(self.Notes)
 	return self.Notes[int(pos)%notes]
 }
 
 // AddTo adds a Note to the pattern at pos
-func (self *Pattern) AddTo(pos uint64, note *lightning.Note) error {
+func (self *Pattern) AddTo(pos uint64, note *Note) error {
 	if pos >= uint64(self.Length) {
 		return self.indexTooLarge(pos)
 	}
-	// try to insert to a nil position
+	err := self.validNote(note)
+	if err != nil {
+		return err
+	}
+	// try to insert to the first nil position
 	inserted := false
 	notes := self.Notes[int(pos)]
 	for i, n := range notes {
 		if n == nil {
 			inserted = true
 			notes[i] = note
+			break
 		}
 	}
 	// if there were no nil positions, append
@@ -51,14 +97,14 @@ func (self *Pattern) AddTo(pos uint64, note *lightning.Note) error {
 }
 
 // RemoveFrom removes a note from a particular position in a pattern
-func (self *Pattern) RemoveFrom(pos uint64, note *lightning.Note) error {
+func (self *Pattern) RemoveFrom(pos uint64, note *Note) error {
 	if pos >= uint64(self.Length) {
 		return self.indexTooLarge(pos)
 	}
-	// remove a note with the same sample and same number, if one exists
+	// remove a note with the same sample, number and track, if one exists
 	notes := self.Notes[int(pos)]
 	for i, n := range notes {
-		if n != nil && n.Number == note.Number && n.Sample == note.Sample {
+		if n != nil && n.Number == note.Number && n.Sample == note.Sample && n.Track == note.Track {
 			notes[i] = nil
 		}
 	}
@@ -70,22 +116,72 @@ func (self *Pattern) Clear(pos uint64) error {
 	if pos >= uint64(self.Length) {
 		return self.indexTooLarge(pos)
 	}
-	self.Notes[pos] = make([]*lightning.Note, 0)
+	self.Notes[pos] = make([]*Note, 0)
+	return nil
+}
+
+// Events returns the notes in the pattern as a slice of Events,
+// ordered by position
+func (self *Pattern) Events() []Event {
+	events := make([]Event, 0)
+	for pos, notes := range self.Notes {
+		for _, note := range notes {
+			if note != nil {
+				events = append(events, Event{uint64(pos), note})
+			}
+		}
+	}
+	return events
+}
+
+// maxPatternLength is the largest number of steps in a pattern,
+// 16 times the length of the default pattern
+const maxPatternLength = 16 * patternLength
+
+// validLength returns an error if a pattern can not have length
+// steps
+func validLength(length int) error {
+	if length <= 0 {
+		return fmt.Errorf("pattern length (%d) must be positive", length)
+	}
+	if length > maxPatternLength {
+		return fmt.Errorf("pattern length (%d) can not be greater than %d", length, maxPatternLength)
+	}
 	return nil
 }
 
 // NewPattern creates a Pattern with the specified size
 func NewPattern(size int) *Pattern {
 	return &Pattern{
-		size,
-		make([][]*lightning.Note, size),
+		Length: size,
+		Notes:  make([][]*Note, size),
+	}
+}
+
+// Copy returns a copy of the pattern with a new name.
+// Notes are shared between the copies, since they are never
+// modified once they have been added to a pattern.
+func (self *Pattern) Copy(name string) *Pattern {
+	pat := NewPattern(self.Length)
+	pat.Name = name
+	pat.Swing = self.Swing
+	pat.Groove = self.Groove
+	pat.Meter = self.Meter
+	pat.Loop = self.Loop
+	for pos, notes := range self.Notes {
+		pat.Notes[pos] = append([]*Note(nil), notes...)
 	}
+	for _, track := range self.Tracks {
+		t := *track
+		pat.Tracks = append(pat.Tracks, &t)
+	}
+	return pat
 }
 
 // Event represents a single edit operation on a pattern
 type Event struct {
-	Pos  uint64          `json:"pos"`
-	Note *lightning.Note `json:"note"`
+	Pos  uint64 `json:"pos"`
+	Note *Note  `json:"note"`
 }
 
 func (self *Event) WriteJSON(w io.Writer) error {
@@ -104,9 +200,52 @@ func ReadEvent(r io.Reader) (*Event, error) {
 
 func ReadEvents(r io.Reader) ([]Event, error) {
 	dec, pes := json.NewDecoder(r), make([]Event, 0)
-	ed := dec.Decode(pes)
+	ed := dec.Decode(&pes)
 	if ed != nil {
 		return nil, ed
 	}
 	return pes, nil
 }
+
+// StreamEvents reads a JSON array of Events from r one event
+// at a time and calls fn with the index of each event, so
+// arrays that are too large to hold in memory can be read.
+// Events that can not be decoded are passed to fn with their
+// error instead. Reading goes on after an event of the wrong
+// type but stops after malformed JSON, and the error is also
+// returned. Reading stops at the first error fn returns.
+func StreamEvents(r io.Reader, fn func(index int, ev *Event, err error) error) error {
+	dec := json.NewDecoder(r)
+	tok, ed := dec.Token()
+	if ed != nil {
+		return ed
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return errors.New("events must be a JSON array")
+	}
+	i := 0
+	for ; dec.More(); i++ {
+		pe := new(Event)
+		ed = dec.Decode(pe)
+		if _, wrongType := ed.(*json.UnmarshalTypeError); wrongType {
+			pe = nil
+		} else if ed != nil {
+			break
+		}
+		ef := fn(i, pe, ed)
+		if ef != nil {
+			return ef
+		}
+	}
+	if ed == nil {
+		_, ed = dec.Token()
+	}
+	if ed != nil {
+		ef := fn(i, nil, ed)
+		if ef != nil {
+			return ef
+		}
+		return fmt.Errorf("event %d: %s", i, ed)
+	}
+	return nil
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"encoding/json"
 	"github.com/bmizerany/assert"
-	"github.com/lightning/lightning"
 	"testing"
 )
 
@@ -15,13 +14,13 @@ func TestPatternLength(t *testing.T) {
 func TestPatternNotesAt(t *testing.T) {
 	pat := NewPattern(4)
 
-	err := pat.AddTo(0, lightning.NewNote("audio/file.flac", 60, 120))
+	err := pat.AddTo(0, NewNote("audio/file.flac", 60, 120))
 	assert.Equal(t, err, nil)
 
-	err = pat.AddTo(0, lightning.NewNote("audio/file.flac", 62, 120))
+	err = pat.AddTo(0, NewNote("audio/file.flac", 62, 120))
 	assert.Equal(t, err, nil)
 
-	err = pat.AddTo(0, lightning.NewNote("audio/file.flac", 64, 120))
+	err = pat.AddTo(0, NewNote("audio/file.flac", 64, 120))
 	assert.Equal(t, err, nil)
 
 	notes := pat.NotesAt(0)
@@ -31,17 +30,17 @@ func TestPatternNotesAt(t *testing.T) {
 func TestPatternAddTo(t *testing.T) {
 	// setup pattern
 	pat := NewPattern(1)
-	err := pat.AddTo(0, lightning.NewNote("audio/file.flac", 72, 96))
+	err := pat.AddTo(0, NewNote("audio/file.flac", 72, 96))
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = pat.AddTo(0, lightning.NewNote("audio/file.flac", 76, 50))
+	err = pat.AddTo(0, NewNote("audio/file.flac", 76, 50))
 	if err != nil {
 		t.Fatal(err)
 	}
 	
 	// try to add a note at a pos greater than pattern size - 1
-	err = pat.AddTo(uint64(pat.Length+1), lightning.NewNote("file.wav", 59, 114))
+	err = pat.AddTo(uint64(pat.Length+1), NewNote("file.wav", 59, 114))
 	if err == nil {
 		t.Fatalf("expected err when adding note but got nil")
 	}
@@ -58,15 +57,15 @@ func TestPatternAddTo(t *testing.T) {
 func TestPatternRemoveFrom(t *testing.T) {
 	// setup pattern
 	pat := NewPattern(1)
-	err := pat.AddTo(0, lightning.NewNote("audio/file.flac", 72, 96))
+	err := pat.AddTo(0, NewNote("audio/file.flac", 72, 96))
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = pat.AddTo(0, lightning.NewNote("audio/file.flac", 58, 108))
+	err = pat.AddTo(0, NewNote("audio/file.flac", 58, 108))
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = pat.RemoveFrom(0, lightning.NewNote("audio/file.flac", 72, 0))
+	err = pat.RemoveFrom(0, NewNote("audio/file.flac", 72, 0))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -80,14 +79,31 @@ func TestPatternRemoveFrom(t *testing.T) {
 	assert.Equal(t, firstNotes[1].Velocity, int32(108))
 }
 
+func TestPatternAddToAfterRemove(t *testing.T) {
+	pat := NewPattern(1)
+	pat.AddTo(0, NewNote("audio/file.flac", 60, 96))
+	pat.AddTo(0, NewNote("audio/file.flac", 62, 96))
+	pat.RemoveFrom(0, NewNote("audio/file.flac", 60, 0))
+	pat.RemoveFrom(0, NewNote("audio/file.flac", 62, 0))
+	// the new note should only fill the first empty slot
+	err := pat.AddTo(0, NewNote("audio/file.flac", 64, 96))
+	assert.Equal(t, err, nil)
+	notes := pat.NotesAt(0)
+	assert.Equal(t, len(notes), 2)
+	assert.Equal(t, notes[0].Number, int32(64))
+	if notes[1] != nil {
+		t.Fatalf("expected second slot to be empty")
+	}
+}
+
 func TestPatternClear(t *testing.T) {
 	// setup a pattern
 	pat := NewPattern(2)
-	err := pat.AddTo(0, lightning.NewNote("foo.ogg", 93, 72))
+	err := pat.AddTo(0, NewNote("foo.ogg", 93, 72))
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = pat.AddTo(0, lightning.NewNote("foo.ogg", 90, 83))
+	err = pat.AddTo(0, NewNote("foo.ogg", 90, 83))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -119,17 +135,32 @@ func TestPatternClear(t *testing.T) {
 
 func TestPatternEncodeJson(t *testing.T) {
 	pat := NewPattern(1)
-	pat.AddTo(0, lightning.NewNote("audio/file.flac", 56, 101))
+	pat.AddTo(0, NewNote("audio/file.flac", 56, 101))
 	expected := []byte(`{"length":1,"notes":[[{"sample":"audio/file.flac","number":56,"velocity":101}]]}`)
 	bs, err := json.Marshal(pat)
 	assert.Equal(t, err, nil)
 	assert.Equal(t, bs, expected)
 }
 
+func TestPatternNoteDurationJson(t *testing.T) {
+	pat := NewPattern(1)
+	note := NewNote("audio/pad.flac", 60, 90)
+	note.Duration = 8
+	pat.AddTo(0, note)
+	expected := []byte(`{"length":1,"notes":[[{"sample":"audio/pad.flac","number":60,"velocity":90,"duration":8}]]}`)
+	bs, err := json.Marshal(pat)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, bs, expected)
+
+	note.Duration = -1
+	err = pat.AddTo(0, note)
+	assert.Equal(t, err.Error(), "note duration (-1) can not be negative")
+}
+
 func TestPatternDecodeJson(t *testing.T) {
 	expected := NewPattern(2)
-	expected.AddTo(0, lightning.NewNote("audio/file1.flac", 55, 84))
-	expected.AddTo(1, lightning.NewNote("audio/file2.flac", 54, 76))
+	expected.AddTo(0, NewNote("audio/file1.flac", 55, 84))
+	expected.AddTo(1, NewNote("audio/file2.flac", 54, 76))
 	bs := []byte(`{"length":2,"notes":[[{"sample":"audio/file1.flac","number":55,"velocity":84}],[{"sample":"audio/file2.flac","number":54,"velocity":76}]]}`)
 	pat := new(Pattern)
 	err := json.Unmarshal(bs, &pat)
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// project persists the sequencer's patterns and song to a file.
+// The file contains a JSON Bank. Older project files that contain
+// a JSON array of Events (see test_pattern.json) are loaded into
+// the playing pattern.
+type project struct {
+	path string
+	seq  *sequencer
+	// hub is used to take a snapshot of the sequencer that matches
+	// the session log, it is nil if there is no session log
+	hub *hub
+	// saved is the number of sequencer edits at the last save
+	saved uint64
+	// logged is the Seq of the last update in the project file
+	logged uint64
+	// mu serializes saves
+	mu sync.Mutex
+}
+
+// load replaces the sequencer's patterns with the ones in
+// the project file. A project file that does not exist yet
+// is not an error, it will be created on the first save.
+func (self *project) load() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	bs, er := ioutil.ReadFile(self.path)
+	if os.IsNotExist(er) {
+		return nil
+	}
+	if er != nil {
+		return er
+	}
+	var es error
+	if trimmed := bytes.TrimSpace(bs); len(trimmed) > 0 && trimmed[0] == '[' {
+		events, ed := ReadEvents(bytes.NewReader(bs))
+		if ed != nil {
+			return ed
+		}
+		es = self.seq.SetEvents("", events)
+	} else {
+		bank := new(Bank)
+		ed := json.Unmarshal(bs, bank)
+		if ed != nil {
+			return ed
+		}
+		es = self.seq.SetBank(bank)
+		self.logged = bank.Seq
+	}
+	if es != nil {
+		return es
+	}
+	self.saved = self.seq.Edits()
+	return nil
+}
+
+// readBank reads a project file without a sequencer. The events
+// of an older project file are read into a pattern named main.
+// A bank is checked as a sequencer would check it, see SetBank.
+func readBank(path string) (*Bank, error) {
+	bs, er := ioutil.ReadFile(path)
+	if er != nil {
+		return nil, er
+	}
+	bank := new(Bank)
+	if trimmed := bytes.TrimSpace(bs); len(trimmed) == 0 || trimmed[0] != '[' {
+		ed := json.Unmarshal(bs, bank)
+		if ed != nil {
+			return nil, ed
+		}
+		ev := newSequencer(newNullEngine(), newVirtualClock(), 1, 120).SetBank(bank)
+		if ev != nil {
+			return nil, ev
+		}
+		return bank, nil
+	}
+	events, ed := ReadEvents(bytes.NewReader(bs))
+	if ed != nil {
+		return nil, ed
+	}
+	pat := NewPattern(patternLength)
+	pat.Name = defaultPattern
+	for _, ev := range events {
+		if ev.Note == nil {
+			return nil, fmt.Errorf("event at pos %d has no note", ev.Pos)
+		}
+		ea := pat.AddTo(ev.Pos, ev.Note)
+		if ea != nil {
+			return nil, ea
+		}
+	}
+	bank.Patterns, bank.Playing = []*Pattern{pat}, pat.Name
+	return bank, nil
+}
+
+// save writes the sequencer's patterns to the project file.
+// The bank is written to a temporary file which is then
+// renamed, so the project file is never left half-written.
+// The changes in the session log that are now in the project
+// file are removed from the log.
+func (self *project) save() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	var edits uint64
+	var bank *Bank
+	snapshot := func(seq uint64) error {
+		edits, bank = self.seq.Edits(), self.seq.Bank()
+		bank.Seq = seq
+		return nil
+	}
+	if self.hub != nil {
+		self.hub.hold(snapshot)
+	} else {
+		snapshot(0)
+	}
+	bs, em := json.MarshalIndent(bank, "", "    ")
+	if em != nil {
+		return em
+	}
+	ew := writeAtomic(self.path, append(bs, '\n'))
+	if ew != nil {
+		return ew
+	}
+	self.saved = edits
+	self.logged = bank.Seq
+	if self.hub == nil {
+		return nil
+	}
+	return self.hub.hold(func(seq uint64) error {
+		return self.hub.journal.compact(bank.Seq)
+	})
+}
+
+// writeAtomic writes bs to a temporary file which is then
+// renamed to path, so path is never left half-written
+func writeAtomic(path string, bs []byte) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, et := ioutil.TempFile(dir, base+".tmp")
+	if et != nil {
+		return et
+	}
+	_, ew := tmp.Write(bs)
+	if ew == nil {
+		ew = tmp.Sync()
+	}
+	ec := tmp.Close()
+	if ew == nil {
+		ew = ec
+	}
+	if ew == nil {
+		ew = os.Rename(tmp.Name(), path)
+	}
+	if ew != nil {
+		os.Remove(tmp.Name())
+	}
+	return ew
+}
+
+// dirty returns true if the patterns have changed since the last save
+func (self *project) dirty() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.seq.Edits() != self.saved
+}
+
+// autosave saves the project every interval if the patterns
+// have changed, until stop is closed
+func (self *project) autosave(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	self.saveOn(ticker.C, stop)
+}
+
+// saveOn saves the project whenever it receives from ticks if
+// the patterns have changed, until stop is closed
+func (self *project) saveOn(ticks <-chan time.Time, stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticks:
+			if !self.dirty() {
+				continue
+			}
+			err := self.save()
+			if err != nil {
+				log.Printf("could not autosave %s: %s\n", self.path, err)
+			}
+		}
+	}
+}
+
+// newProject creates a project that saves the sequencer's
+// patterns to path
+func newProject(path string, seq *sequencer) *project {
+	return &project{path: path, seq: seq}
+}
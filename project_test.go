@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestProjectLoad(t *testing.T) {
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 16, 120)
+	proj := newProject("test_pattern.json", seq)
+	err := proj.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, _ := seq.Events("")
+	assert.Equal(t, len(events), 8)
+	notes := seq.NotesAt("", 3)
+	assert.Equal(t, len(notes), 1)
+	assert.Equal(t, notes[0].Sample, "blip.wav")
+	assert.Equal(t, notes[0].Number, int32(65))
+	assert.Equal(t, proj.dirty(), false)
+}
+
+func TestProjectLoadMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 16, 120)
+	proj := newProject(filepath.Join(dir, "new.json"), seq)
+	err = proj.load()
+	assert.Equal(t, err, nil)
+	events, _ := seq.Events("")
+	assert.Equal(t, len(events), 0)
+}
+
+func TestProjectLoadInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "song.json")
+	ioutil.WriteFile(path, []byte(`{"patterns":[null]}`), 0644)
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 16, 120)
+	err = newProject(path, seq).load()
+	assert.Equal(t, err.Error(), "pattern 0 can not be nil")
+	_, err = readBank(path)
+	assert.Equal(t, err.Error(), "pattern 0 can not be nil")
+}
+
+func TestProjectSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "song.json")
+
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 16, 120)
+	seq.AddTo("", 0, NewNote("kick", 60, 100))
+	seq.AddTo("", 4, NewNote("snare", 62, 90))
+	proj := newProject(path, seq)
+	assert.Equal(t, proj.dirty(), true)
+	err = proj.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, proj.dirty(), false)
+	// no temporary files are left behind
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, len(files), 1)
+
+	// load it into a new sequencer
+	other := newSequencer(newNullEngine(), newVirtualClock(), 16, 120)
+	err = newProject(path, other).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, other.Bank(), seq.Bank())
+}
+
+func TestProjectAutosave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "song.json")
+
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 16, 120)
+	proj := newProject(path, seq)
+	ticks, stop := make(chan time.Time), make(chan bool)
+	defer close(stop)
+	go proj.saveOn(ticks, stop)
+	// a clean project is not saved
+	ticks <- time.Now()
+	ticks <- time.Now()
+	_, err = os.Stat(path)
+	assert.Equal(t, os.IsNotExist(err), true)
+
+	// the second tick is only received once the
+	// save the first one started has finished
+	seq.AddTo("", 2, NewNote("kick", 60, 100))
+	ticks <- time.Now()
+	ticks <- time.Now()
+	assert.Equal(t, proj.dirty(), false)
+	_, err = os.Stat(path)
+	assert.Equal(t, err, nil)
+}
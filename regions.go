@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// regionsFile is the file in the sample directory
+	// that regions are saved to
+	regionsFile = ".regions.json"
+	// regionDir is the directory in the sample directory
+	// that the audio of regions is written to
+	regionDir = ".regions"
+	// sliceWindow is the number of frames the energy of a
+	// sample is measured over to find its transients
+	sliceWindow = 256
+	// sliceGap is the shortest time between two slices in seconds
+	sliceGap = 0.05
+)
+
+// Region is a part of a sample in the pool that is played as a
+// sample of its own, named Name. Start and End are frames of the
+// sample, from Start up to but not including End, and an End of 0
+// is the end of the sample. Loop is in frames of the region, and is
+// written to the region's audio for engines that loop held notes.
+// Regions can only be made of WAV samples.
+type Region struct {
+	Name   string `json:"name"`
+	Sample string `json:"sample"`
+	Start  int    `json:"start"`
+	End    int    `json:"end"`
+	Loop   *Loop  `json:"loop,omitempty"`
+}
+
+// regions sorts regions by name
+type regions []*Region
+
+func (self regions) Len() int {
+	return len(self)
+}
+
+func (self regions) Less(i, j int) bool {
+	return self[i].Name < self[j].Name
+}
+
+func (self regions) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+// SliceRequest asks POST /samples/slice to slice a sample
+// into a number of regions at its transients
+type SliceRequest struct {
+	Sample string `json:"sample"`
+	Slices int    `json:"slices"`
+}
+
+// regionPath returns the path of the audio of a region
+// relative to the sample directory, separated by slashes
+func regionPath(name string) string {
+	return path.Join(regionDir, url.QueryEscape(name)+".wav")
+}
+
+// readRegions reads the regions from the regions file in the
+// sample directory. It is not an error if the file does not exist.
+func (self *samples) readRegions() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	list := make([]*Region, 0)
+	bs, er := ioutil.ReadFile(filepath.Join(self.dir, regionsFile))
+	if er != nil && !os.IsNotExist(er) {
+		return er
+	}
+	if er == nil {
+		ed := json.Unmarshal(bs, &list)
+		if ed != nil {
+			return ed
+		}
+	}
+	self.regions = make(map[string]*Region, len(list))
+	for _, region := range list {
+		self.regions[region.Name] = region
+	}
+	return nil
+}
+
+// saveRegions writes the regions to the regions file in the
+// sample directory. The caller must hold mu.
+func (self *samples) saveRegions() error {
+	list := make(regions, 0, len(self.regions))
+	for _, region := range self.regions {
+		list = append(list, region)
+	}
+	sort.Stable(list)
+	bs, em := json.MarshalIndent(list, "", "    ")
+	if em != nil {
+		return em
+	}
+	return writeAtomic(filepath.Join(self.dir, regionsFile), append(bs, '\n'))
+}
+
+// Regions returns the regions, sorted by name
+func (self *samples) Regions() []Region {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	list := make(regions, 0, len(self.regions))
+	for _, region := range self.regions {
+		list = append(list, region)
+	}
+	sort.Stable(list)
+	result := make([]Region, len(list))
+	for i, region := range list {
+		result[i] = *region
+	}
+	return result
+}
+
+// removeRegion deletes the audio of a region. It is not an
+// error if the audio has not been written. The caller must hold mu.
+func (self *samples) removeRegion(name string) {
+	f := filepath.Join(self.dir, filepath.FromSlash(regionPath(name)))
+	er := os.Remove(f)
+	if er != nil && !os.IsNotExist(er) {
+		log.Printf("could not remove region %s: %s\n", name, er)
+	}
+}
+
+// regionsOf returns the names of the regions of a sample file,
+// sorted by name. Regions have no regions of their own.
+func (self *samples) regionsOf(name string) []string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	names := make([]string, 0)
+	if file, exists := self.files[name]; exists && file.info.Region != nil {
+		return names
+	}
+	for regionName, region := range self.regions {
+		if region.Sample == name {
+			names = append(names, regionName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// scanRegions adds the regions of the samples in files to files.
+// The audio of a region is written again if its sample has changed
+// since it was last written. A region whose sample was renamed
+// follows it, and true is returned so the regions are saved. Regions
+// of samples that do not exist and regions with the name of a sample
+// file are left out. The caller must hold mu.
+func (self *samples) scanRegions(files, old map[string]*sampleFile) bool {
+	moved := false
+	for _, region := range self.regions {
+		if _, exists := files[region.Name]; exists {
+			log.Printf("region %s has the name of a sample file\n", region.Name)
+			continue
+		}
+		source, exists := files[region.Sample]
+		if prev, existed := old[region.Sample]; !exists && existed {
+			for name, file := range files {
+				if file.info.Region == nil && os.SameFile(prev.stat, file.stat) {
+					region.Sample, source, exists, moved = name, file, true, true
+					break
+				}
+			}
+		}
+		if !exists || source.info.Region != nil {
+			continue
+		}
+		file, err := self.scanRegion(region, source, old[region.Name])
+		if err != nil {
+			log.Printf("could not write region %s: %s\n", region.Name, err)
+			continue
+		}
+		files[region.Name] = file
+	}
+	return moved
+}
+
+// scanRegion returns the sampleFile of a region of source, writing
+// its audio if it is older than source. The header of the audio is
+// only read again if it has changed since prev was scanned.
+func (self *samples) scanRegion(region *Region, source, prev *sampleFile) (*sampleFile, error) {
+	rel := regionPath(region.Name)
+	f := filepath.Join(self.dir, filepath.FromSlash(rel))
+	stat, es := os.Stat(f)
+	if es != nil || stat.ModTime().Before(source.stat.ModTime()) {
+		buf, er := self.readSource(source)
+		if er != nil {
+			return nil, er
+		}
+		ew := self.writeRegion(region, buf)
+		if ew != nil {
+			return nil, ew
+		}
+		stat, es = os.Stat(f)
+		if es != nil {
+			return nil, es
+		}
+	}
+	file := &sampleFile{path: rel, stat: stat}
+	if prev != nil && prev.unchanged(rel, stat) {
+		file.info = prev.info
+	} else {
+		var er error
+		file.info, er = readSampleInfo(f)
+		if er != nil {
+			return nil, er
+		}
+		file.info.Name, file.info.Folder = region.Name, path.Dir(region.Name)
+		if file.info.Folder == "." {
+			file.info.Folder = ""
+		}
+	}
+	copied := *region
+	file.info.Region = &copied
+	return file, nil
+}
+
+// source returns the sample file that a region of a sample is
+// made of. The caller must hold mu.
+func (self *samples) source(name string) (*sampleFile, error) {
+	file, exists := self.files[name]
+	if !exists || file.info.Region != nil {
+		return nil, &requestError{codeNotFound, fmt.Sprintf("sample %s does not exist", name)}
+	}
+	if file.info.Format != "wav" {
+		msg := fmt.Sprintf("regions of %s files are not supported", file.info.Format)
+		return nil, &requestError{codeInvalid, msg}
+	}
+	return file, nil
+}
+
+// readSource reads the audio of a sample file in the sample
+// directory. The caller must hold mu.
+func (self *samples) readSource(source *sampleFile) (*audioBuffer, error) {
+	file, eo := os.Open(filepath.Join(self.dir, filepath.FromSlash(source.path)))
+	if eo != nil {
+		return nil, eo
+	}
+	defer file.Close()
+	buf, er := readWav(file)
+	if er != nil {
+		return nil, fmt.Errorf("sample %s: %s", source.info.Name, er)
+	}
+	return buf, nil
+}
+
+// writeRegion writes the audio of a region of a sample in buf to
+// the region directory as a WAV file. The loop of the region is
+// written to a smpl chunk. The caller must hold mu.
+func (self *samples) writeRegion(region *Region, buf *audioBuffer) error {
+	end := region.End
+	if end == 0 {
+		end = len(buf.frames)
+	}
+	if region.Start < 0 || region.Start >= end || end > len(buf.frames) {
+		msg := fmt.Sprintf("region %s (%d to %d) is not in the %d frames of %s",
+			region.Name, region.Start, end, len(buf.frames), region.Sample)
+		return &requestError{codeInvalid, msg}
+	}
+	out := new(bytes.Buffer)
+	ew := writeWav(out, &audioBuffer{buf.rate, buf.frames[region.Start:end]})
+	if ew != nil {
+		return ew
+	}
+	bs := out.Bytes()
+	if region.Loop != nil {
+		loop, frames := region.Loop, end-region.Start
+		if loop.Start >= loop.End || loop.End > uint64(frames) {
+			msg := fmt.Sprintf("loop of region %s (%d to %d) is not in its %d frames",
+				region.Name, loop.Start, loop.End, frames)
+			return &requestError{codeInvalid, msg}
+		}
+		bs = append(bs, smplChunk(buf.rate, region.Loop)...)
+		binary.LittleEndian.PutUint32(bs[4:], uint32(len(bs)-8))
+	}
+	f := filepath.Join(self.dir, filepath.FromSlash(regionPath(region.Name)))
+	em := os.MkdirAll(filepath.Dir(f), 0755)
+	if em != nil {
+		return em
+	}
+	return writeAtomic(f, bs)
+}
+
+// smplChunk returns a WAV smpl chunk with a forward loop that
+// plays over and over. The last frame of a smpl loop is part of
+// the loop, unlike the End of a Loop.
+func smplChunk(rate int, loop *Loop) []byte {
+	le := binary.LittleEndian
+	chunk := make([]byte, 8+36+24)
+	copy(chunk, "smpl")
+	le.PutUint32(chunk[4:], 36+24)
+	le.PutUint32(chunk[16:], uint32(1e9/float64(rate)))
+	le.PutUint32(chunk[20:], rootNote)
+	le.PutUint32(chunk[36:], 1)
+	le.PutUint32(chunk[52:], uint32(loop.Start))
+	le.PutUint32(chunk[56:], uint32(loop.End-1))
+	return chunk
+}
+
+// Define adds a region to the pool, or replaces the region with
+// the same name, and saves the regions. The region's audio is
+// written right away, so a region that does not fit in its sample
+// is an error. It is played when the sample directory is rescanned.
+func (self *samples) Define(region Region) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.dir == "" {
+		return errors.New("there is no sample directory")
+	}
+	if region.Name == "" || region.Name != strings.Trim(region.Name, "/") {
+		return &requestError{codeInvalid, fmt.Sprintf("region name %q is not valid", region.Name)}
+	}
+	if file, exists := self.files[region.Name]; exists && file.info.Region == nil {
+		return &requestError{codeConflict, fmt.Sprintf("sample %s already exists", region.Name)}
+	}
+	source, es := self.source(region.Sample)
+	if es != nil {
+		return es
+	}
+	buf, er := self.readSource(source)
+	if er != nil {
+		return er
+	}
+	ew := self.writeRegion(&region, buf)
+	if ew != nil {
+		return ew
+	}
+	self.regions[region.Name] = &region
+	return self.saveRegions()
+}
+
+// Slice replaces the regions of a sample that are named after it,
+// e.g. breaks/amen:1, with n regions that start at the sample's
+// strongest transients and returns them. The first region starts
+// at the start of the sample and the last one ends at its end.
+// They are played when the sample directory is rescanned.
+func (self *samples) Slice(sample string, n int) ([]Region, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if n < 1 {
+		return nil, &requestError{codeInvalid, fmt.Sprintf("slices (%d) must be positive", n)}
+	}
+	source, es := self.source(sample)
+	if es != nil {
+		return nil, es
+	}
+	buf, er := self.readSource(source)
+	if er != nil {
+		return nil, er
+	}
+	starts, ef := transients(buf, n)
+	if ef != nil {
+		return nil, &requestError{codeInvalid, fmt.Sprintf("can not slice %s: %s", sample, ef)}
+	}
+	for i := 1; i <= n; i++ {
+		name := sample + ":" + strconv.Itoa(i)
+		if file, exists := self.files[name]; exists && file.info.Region == nil {
+			return nil, &requestError{codeConflict, fmt.Sprintf("sample %s already exists", name)}
+		}
+	}
+	for name, region := range self.regions {
+		if region.Sample == sample && strings.HasPrefix(name, sample+":") {
+			delete(self.regions, name)
+			self.removeRegion(name)
+		}
+	}
+	sliced := make([]Region, n)
+	for i, start := range starts {
+		end := len(buf.frames)
+		if i+1 < n {
+			end = starts[i+1]
+		}
+		sliced[i] = Region{Name: sample + ":" + strconv.Itoa(i+1), Sample: sample, Start: start, End: end}
+		region := sliced[i]
+		ew := self.writeRegion(&region, buf)
+		if ew != nil {
+			return nil, ew
+		}
+		self.regions[region.Name] = &region
+	}
+	return sliced, self.saveRegions()
+}
+
+// onsets sorts windows of a sample by how much louder they
+// are than the window before them, loudest first
+type onsets struct {
+	windows []int
+	flux    []float64
+}
+
+func (self *onsets) Len() int {
+	return len(self.windows)
+}
+
+func (self *onsets) Less(i, j int) bool {
+	return self.flux[self.windows[i]] > self.flux[self.windows[j]]
+}
+
+func (self *onsets) Swap(i, j int) {
+	self.windows[i], self.windows[j] = self.windows[j], self.windows[i]
+}
+
+// transients returns the first frames of n slices of a sample.
+// The first slice starts at frame 0 and the others start at the
+// n-1 windows whose energy rises the most over the window before
+// them, at least sliceGap apart.
+func transients(buf *audioBuffer, n int) ([]int, error) {
+	energy := make([]float64, len(buf.frames)/sliceWindow)
+	for i := range energy {
+		for _, frame := range buf.frames[i*sliceWindow : (i+1)*sliceWindow] {
+			energy[i] += float64(frame[0]*frame[0] + frame[1]*frame[1])
+		}
+	}
+	flux := make([]float64, len(energy))
+	peaks := &onsets{nil, flux}
+	for i := 1; i < len(energy); i++ {
+		flux[i] = math.Max(0, energy[i]-energy[i-1])
+	}
+	for i := 1; i < len(flux); i++ {
+		if flux[i] > 0 && flux[i] > flux[i-1] && (i+1 == len(flux) || flux[i] >= flux[i+1]) {
+			peaks.windows = append(peaks.windows, i)
+		}
+	}
+	sort.Stable(peaks)
+	gap := int(math.Max(1, math.Ceil(sliceGap*float64(buf.rate)/sliceWindow)))
+	picked := []int{0}
+	for _, window := range peaks.windows {
+		if len(picked) == n {
+			break
+		}
+		near := false
+		for _, p := range picked {
+			if window-p < gap && p-window < gap {
+				near = true
+				break
+			}
+		}
+		if !near {
+			picked = append(picked, window)
+		}
+	}
+	if len(picked) < n {
+		return nil, fmt.Errorf("found %d transients, which is too few for %d slices", len(picked)-1, n)
+	}
+	sort.Ints(picked)
+	starts := make([]int, n)
+	for i, window := range picked {
+		starts[i] = window * sliceWindow
+	}
+	return starts, nil
+}
+
+// regions returns an http handler that lists the regions (GET)
+// as a JSON array, or adds or replaces a region (PUT) with a JSON
+// Region and responds with the SampleInfo of the region
+func (self *server) regions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		switch r.Method {
+		case "GET":
+			err = respondJSON(w, http.StatusOK, self.samples.Regions())
+		case "PUT":
+			region := Region{}
+			err = json.NewDecoder(r.Body).Decode(&region)
+			if err != nil {
+				err = &requestError{codeMalformed, err.Error()}
+				break
+			}
+			var infos []SampleInfo
+			infos, err = self.addRegions(func() ([]Region, error) {
+				return []Region{region}, self.samples.Define(region)
+			})
+			if err == nil {
+				err = respondJSON(w, http.StatusOK, infos[0])
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("method not allowed"))
+		}
+		if err != nil {
+			w.WriteHeader(httpStatus(err))
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
+
+// slice returns an http handler that slices a sample (POST) as
+// selected by a JSON SliceRequest and responds with the
+// SampleInfos of the slices
+func (self *server) slice() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		var infos []SampleInfo
+		req := new(SliceRequest)
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("method not allowed"))
+			return
+		}
+		err = json.NewDecoder(r.Body).Decode(req)
+		if err != nil {
+			err = &requestError{codeMalformed, err.Error()}
+		} else {
+			infos, err = self.addRegions(func() ([]Region, error) {
+				return self.samples.Slice(req.Sample, req.Slices)
+			})
+		}
+		if err == nil {
+			err = respondJSON(w, http.StatusOK, infos)
+		}
+		if err != nil {
+			w.WriteHeader(httpStatus(err))
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
+
+// addRegions adds the regions define returns to the pool by
+// rescanning the sample directory, which broadcasts them to
+// every client, and returns their SampleInfos
+func (self *server) addRegions(define func() ([]Region, error)) ([]SampleInfo, error) {
+	defined, err := define()
+	if err != nil {
+		return nil, err
+	}
+	_, err = self.rescanSamples()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]SampleInfo, len(defined))
+	for i, region := range defined {
+		info, exists := self.samples.info(region.Name)
+		if !exists {
+			return nil, fmt.Errorf("region %s was removed while it was defined", region.Name)
+		}
+		infos[i] = info
+	}
+	return infos, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// regionServer returns a server with a sample directory that holds
+// a break with hits at frames 0, 4096, 8960 and 15104 and a flac file
+func regionServer(t *testing.T) (*server, string) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &audioBuffer{8000, make([][2]float32, 20000)}
+	for _, hit := range []int{0, 4096, 8960, 15104} {
+		for i := 0; i < 1000; i++ {
+			level := 0.9 * float32(1000-i) / 1000
+			buf.frames[hit+i] = [2]float32{level, -level}
+		}
+	}
+	wav := new(bytes.Buffer)
+	writeWav(wav, buf)
+	ioutil.WriteFile(filepath.Join(dir, "break.wav"), wav.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "snare.flac"), flacHeader(44100, 2, 16, 441), 0644)
+	srv := newTestServer(t)
+	err = srv.readSamples(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv, dir
+}
+
+// regionFrames returns the number of frames in the audio of a region
+func regionFrames(t *testing.T, smp *samples, name string) int {
+	samplePath, exists := smp.lookup(name)
+	if !exists {
+		t.Fatal("no sample " + name)
+	}
+	file, err := os.Open(samplePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	buf, err := readWav(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(buf.frames)
+}
+
+func TestTransients(t *testing.T) {
+	srv, dir := regionServer(t)
+	defer os.RemoveAll(dir)
+	srv.samples.mu.Lock()
+	buf, err := srv.samples.readSource(srv.samples.files["break"])
+	srv.samples.mu.Unlock()
+	assert.Equal(t, err, nil)
+	starts, err := transients(buf, 4)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, starts, []int{0, 4096, 8960, 15104})
+	starts, err = transients(buf, 2)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(starts), 2)
+	assert.Equal(t, starts[0], 0)
+	_, err = transients(buf, 5)
+	assert.Equal(t, err.Error(), "found 3 transients, which is too few for 5 slices")
+}
+
+func TestSampleSlice(t *testing.T) {
+	srv, dir := regionServer(t)
+	defer os.RemoveAll(dir)
+	handler := srv.slice()
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/samples/slice", bytes.NewBufferString(`{"sample":"break","slices":4}`)))
+	assert.Equal(t, w.Code, http.StatusOK)
+	infos := make([]SampleInfo, 0)
+	err := json.Unmarshal(w.Body.Bytes(), &infos)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(infos), 4)
+	assert.Equal(t, infos[1].Name, "break:2")
+	assert.Equal(t, infos[1].Format, "wav")
+	assert.Equal(t, *infos[1].Region, Region{"break:2", "break", 4096, 8960, nil})
+	assert.Equal(t, *infos[3].Region, Region{"break:4", "break", 15104, 20000, nil})
+	assert.Equal(t, regionFrames(t, srv.samples, "break:1"), 4096)
+	assert.Equal(t, regionFrames(t, srv.samples, "break:4"), 4896)
+
+	// regions are saved alongside the pool
+	smp := newSamples(nil)
+	err = smp.readSamples(dir)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(smp.Regions()), 4)
+	assert.Equal(t, regionFrames(t, smp, "break:3"), 6144)
+
+	// slicing again replaces the slices
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/samples/slice", bytes.NewBufferString(`{"sample":"break","slices":2}`)))
+	assert.Equal(t, w.Code, http.StatusOK)
+	regions := srv.samples.Regions()
+	assert.Equal(t, len(regions), 2)
+	_, exists := srv.samples.lookup("break:3")
+	assert.Equal(t, exists, false)
+	// and deletes the audio of the old ones
+	files, err := ioutil.ReadDir(filepath.Join(dir, regionDir))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(files), 2)
+	_, err = srv.rescanSamples()
+	assert.Equal(t, err, nil)
+	_, exists = srv.samples.lookup("break:3")
+	assert.Equal(t, exists, false)
+
+	failures := map[string]int{
+		`{"sample":"break","slices":9}`: http.StatusBadRequest,
+		`{"sample":"break","slices":0}`: http.StatusBadRequest,
+		`{"sample":"snare","slices":2}`: http.StatusBadRequest,
+		`{"sample":"clap","slices":2}`:  http.StatusNotFound,
+		`{"sample":`:                    http.StatusBadRequest,
+	}
+	for body, status := range failures {
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/samples/slice", bytes.NewBufferString(body)))
+		assert.Equal(t, w.Code, status)
+	}
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/samples/slice", nil))
+	assert.Equal(t, w.Code, http.StatusMethodNotAllowed)
+}
+
+func TestSampleRegions(t *testing.T) {
+	srv, dir := regionServer(t)
+	defer os.RemoveAll(dir)
+	handler := srv.regions()
+
+	w := httptest.NewRecorder()
+	body := `{"name":"loops/hit","sample":"break","start":4096,"end":8960,"loop":{"start":100,"end":600}}`
+	handler(w, httptest.NewRequest("PUT", "/samples/regions", bytes.NewBufferString(body)))
+	assert.Equal(t, w.Code, http.StatusOK)
+	info := SampleInfo{}
+	err := json.Unmarshal(w.Body.Bytes(), &info)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, info.Name, "loops/hit")
+	assert.Equal(t, info.Folder, "loops")
+	assert.Equal(t, *info.Region.Loop, Loop{100, 600})
+	assert.Equal(t, regionFrames(t, srv.samples, "loops/hit"), 4864)
+	samplePath, _ := srv.samples.lookup("loops/hit")
+	bs, _ := ioutil.ReadFile(samplePath)
+	assert.Equal(t, bytes.Contains(bs, []byte("smpl")), true)
+
+	// a region plays as a sample of its own
+	pool := srv.samples.paths()
+	assert.Equal(t, pool["loops/hit"], samplePath)
+	srv.seq.AddTo("", 0, NewNote("loops/hit", 60, 100))
+	srv.seq.AddTo("", 1, NewNote("hat", 60, 100))
+	steps(t, srv.seq, 1)
+	// notes whose sample is not in the pool are not played
+	err = srv.seq.step()
+	assert.Equal(t, err.Error(), "sample hat does not exist")
+	played := srv.engine.(*nullEngine).Played()
+	assert.Equal(t, len(played), 1)
+	assert.Equal(t, played[0].Note.Sample, samplePath)
+	srv.seq.Clear("", 0)
+	srv.seq.Clear("", 1)
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/samples/regions", nil))
+	regions := make([]Region, 0)
+	json.Unmarshal(w.Body.Bytes(), &regions)
+	assert.Equal(t, len(regions), 1)
+	assert.Equal(t, regions[0].Sample, "break")
+
+	failures := map[string]int{
+		`{"name":"break","sample":"break"}`:                              http.StatusConflict,
+		`{"name":"hit","sample":"clap"}`:                                 http.StatusNotFound,
+		`{"name":"hit","sample":"snare"}`:                                http.StatusBadRequest,
+		`{"name":"","sample":"break"}`:                                   http.StatusBadRequest,
+		`{"name":"hit","sample":"break","start":300,"end":200}`:          http.StatusBadRequest,
+		`{"name":"hit","sample":"break","end":30000}`:                    http.StatusBadRequest,
+		`{"name":"hit","sample":"break","end":500,"loop":{"end":600}}`:   http.StatusBadRequest,
+		`{"name":"hit","sample":"break","loop":{"start":500,"end":400}}`: http.StatusBadRequest,
+		`{"name":"hit","sample":"break","start":"x"}`:                    http.StatusBadRequest,
+	}
+	for body, status := range failures {
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest("PUT", "/samples/regions", bytes.NewBufferString(body)))
+		assert.Equal(t, w.Code, status)
+	}
+	w = httptest.NewRecorder()
+	body = `{"name":"hit","sample":"break","end":500,"loop":{"end":600}}`
+	handler(w, httptest.NewRequest("PUT", "/samples/regions", bytes.NewBufferString(body)))
+	assert.Equal(t, w.Body.String(), "loop of region hit (0 to 600) is not in its 500 frames")
+	_, exists := srv.samples.lookup("hit")
+	assert.Equal(t, exists, false)
+
+	// regions follow their sample when it is renamed
+	os.Rename(filepath.Join(dir, "break.wav"), filepath.Join(dir, "amen.wav"))
+	_, err = srv.rescanSamples()
+	assert.Equal(t, err, nil)
+	regions = srv.samples.Regions()
+	assert.Equal(t, regions[0].Sample, "amen")
+	_, exists = srv.samples.lookup("loops/hit")
+	assert.Equal(t, exists, true)
+
+	// deleting a region deletes its definition, and deleting a
+	// sample deletes its regions
+	err = srv.deleteSample("loops/hit", false)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(srv.samples.Regions()), 0)
+	_, err = srv.samples.Slice("amen", 2)
+	assert.Equal(t, err, nil)
+	srv.seq.AddTo("", 0, NewNote("amen:2", 60, 100))
+	err = srv.deleteSample("amen", false)
+	assert.Equal(t, err.Error(), "region amen:2 of sample amen is played by main, use force=true to delete it anyway")
+	assert.Equal(t, httpStatus(err), http.StatusConflict)
+	assert.Equal(t, len(srv.samples.Regions()), 2)
+	err = srv.deleteSample("amen", true)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(srv.samples.Regions()), 0)
+	_, err = srv.rescanSamples()
+	assert.Equal(t, err, nil)
+	_, exists = srv.samples.lookup("amen:1")
+	assert.Equal(t, exists, false)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+)
+
+const (
+	// defaultRate is the sample rate patterns are rendered at
+	defaultRate = 44100
+	// rootNote is the note number that plays a sample at
+	// its recorded pitch
+	rootNote = 60
+	// minRenderRate and maxRenderRate bound the sample rate
+	// patterns are rendered at
+	minRenderRate = 8000
+	maxRenderRate = 192000
+	// minRenderTempo and maxRenderTempo bound the tempo
+	// patterns are rendered at
+	minRenderTempo = 20
+	maxRenderTempo = 999
+	// skippedHeader lists the samples a render left out
+	skippedHeader = "X-Skipped-Samples"
+	// maxRenderFrames is the number of frames in the longest
+	// render served over http, 20 minutes at 48 kHz
+	maxRenderFrames = 20 * 60 * 48000
+	// renderChunk is the number of frames mixed at a time
+	renderChunk = 8192
+)
+
+// RenderRequest selects what POST /render renders. The song
+// is rendered if Song is true, otherwise the named pattern is,
+// or the playing pattern if Pattern is empty. A Tempo or Rate
+// of 0 renders at the sequencer's tempo or the default rate.
+type RenderRequest struct {
+	Pattern string  `json:"pattern,omitempty"`
+	Song    bool    `json:"song,omitempty"`
+	Tempo   float32 `json:"tempo,omitempty"`
+	Rate    int     `json:"rate,omitempty"`
+}
+
+// renderer mixes the samples played by patterns into a buffer
+// without the realtime clock of a metro
+type renderer struct {
+	rate int
+	// load reads the sample with a name, it returns a nil
+	// buffer for samples it can not decode
+	load  func(sample string) (*audioBuffer, error)
+	cache map[string]*audioBuffer
+}
+
+// sample returns the sample with a name, reading it once.
+// The sample is nil if it can not be decoded.
+func (self *renderer) sample(name string) (*audioBuffer, error) {
+	if buf, exists := self.cache[name]; exists {
+		return buf, nil
+	}
+	buf, err := self.load(name)
+	if err != nil {
+		return nil, err
+	}
+	self.cache[name] = buf
+	return buf, nil
+}
+
+// play is a note of a rendered pattern. It plays a sample
+// from frame start up to frame stop, stepping through the
+// sample by step frames per frame and scaled by gain.
+type play struct {
+	start, stop int
+	smp         *audioBuffer
+	step        float64
+	gain        float32
+}
+
+// playsSorter sorts plays by the frame they start at
+type playsSorter []*play
+
+func (self playsSorter) Len() int           { return len(self) }
+func (self playsSorter) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+func (self playsSorter) Less(i, j int) bool { return self[i].start < self[j].start }
+
+// mixdown is the audio of rendered patterns. It is mixed a
+// chunk at a time as it is written, so patterns of any length
+// can be rendered. skipped are the names of the samples that
+// could not be decoded, whose notes are left out.
+type mixdown struct {
+	rate    int
+	length  int
+	plays   []*play
+	skipped []string
+}
+
+// score returns the mixdown of patterns played one after the
+// other at tempo. Note numbers set the pitch the samples play
+// at and velocities set their gain. Notes are mixed with the
+// settings of their pattern's tracks and groove. The mixdown is
+// exactly as long as the patterns, so samples that ring past the
+// end are cut off and the audio can be looped. Notes that play
+// samples which can not be decoded are skipped.
+func (self *renderer) score(patterns []*Pattern, tempo float32) (*mixdown, error) {
+	if tempo <= 0 {
+		return nil, fmt.Errorf("tempo (%g) must be positive", tempo)
+	}
+	length := 0.0
+	for _, pat := range patterns {
+		length += float64(pat.Length) * self.stepFrames(pat, tempo)
+	}
+	md := &mixdown{self.rate, int(length + 0.5), make([]*play, 0), nil}
+	skipped := make(map[string]bool)
+	start := 0.0
+	for _, pat := range patterns {
+		perStep := self.stepFrames(pat, tempo)
+		for pos, notes := range pat.Notes {
+			delay, scale := pat.feel(uint64(pos))
+			at := start + (float64(pos)+delay)*perStep
+			for _, note := range pat.mix(notes) {
+				velocity := scaleVelocity(note.Velocity, scale)
+				if velocity <= 0 {
+					continue
+				}
+				smp, err := self.sample(note.Sample)
+				if err != nil {
+					return nil, err
+				}
+				if smp == nil {
+					if !skipped[note.Sample] {
+						skipped[note.Sample] = true
+						md.skipped = append(md.skipped, note.Sample)
+					}
+					continue
+				}
+				step := math.Pow(2, float64(note.Number-rootNote)/12) * float64(smp.rate) / float64(self.rate)
+				// the frame after the last one the sample plays in
+				stop := int(at+0.5) + int(float64(len(smp.frames)-1)/step) + 1
+				if note.Duration > 0 {
+					end := start + float64(pos+note.Duration)*perStep
+					stop = int(math.Min(float64(stop), end+0.5))
+				}
+				if stop > md.length {
+					stop = md.length
+				}
+				p := &play{int(at + 0.5), stop, smp, step, float32(velocity) / maxVelocity}
+				if p.start < p.stop {
+					md.plays = append(md.plays, p)
+				}
+			}
+		}
+		start += float64(pat.Length) * perStep
+	}
+	sort.Stable(playsSorter(md.plays))
+	return md, nil
+}
+
+// render mixes patterns into a buffer, see score
+func (self *renderer) render(patterns []*Pattern, tempo float32) (*audioBuffer, error) {
+	md, err := self.score(patterns, tempo)
+	if err != nil {
+		return nil, err
+	}
+	out := &audioBuffer{md.rate, make([][2]float32, md.length)}
+	md.mix(out, 0, md.plays)
+	return out, nil
+}
+
+// stepFrames returns the number of frames in a step of a
+// pattern at tempo
+func (self *renderer) stepFrames(pat *Pattern, tempo float32) float64 {
+	return float64(self.rate) * 60 / float64(tempo) / float64(pat.meter().Steps)
+}
+
+// mix adds the part of plays from frame offset to the end of
+// out to out. The samples are resampled with linear interpolation
+// to change their pitch and to match the rate of out.
+func (self *mixdown) mix(out *audioBuffer, offset int, plays []*play) {
+	for _, p := range plays {
+		last := len(p.smp.frames) - 1
+		i := p.start
+		if i < offset {
+			i = offset
+		}
+		for ; i < p.stop && i-offset < len(out.frames); i++ {
+			src := float64(i-p.start) * p.step
+			j := int(src)
+			if j > last {
+				break
+			}
+			frac := float32(src - float64(j))
+			for c := 0; c < 2; c++ {
+				s := p.smp.frames[j][c]
+				if j < last {
+					s += (p.smp.frames[j+1][c] - s) * frac
+				}
+				out.frames[i-offset][c] += s * p.gain
+			}
+		}
+	}
+}
+
+// writeWav writes the mixdown as a 16 bit stereo WAV file,
+// mixing renderChunk frames at a time
+func (self *mixdown) writeWav(w io.Writer) error {
+	ew := writeWavHeader(w, self.rate, self.length)
+	if ew != nil {
+		return ew
+	}
+	chunk := &audioBuffer{self.rate, make([][2]float32, renderChunk)}
+	// playing holds the plays that have started, next is the
+	// index of the first that has not
+	playing, next := make([]*play, 0), 0
+	for offset := 0; offset < self.length; offset += renderChunk {
+		frames := chunk.frames[:renderChunk]
+		if self.length-offset < renderChunk {
+			frames = frames[:self.length-offset]
+		}
+		for i := range frames {
+			frames[i] = [2]float32{}
+		}
+		end := offset + len(frames)
+		kept := playing[:0]
+		for _, p := range playing {
+			if p.stop > offset {
+				kept = append(kept, p)
+			}
+		}
+		playing = kept
+		for ; next < len(self.plays) && self.plays[next].start < end; next++ {
+			playing = append(playing, self.plays[next])
+		}
+		self.mix(&audioBuffer{self.rate, frames}, offset, playing)
+		ew = writeWavFrames(w, frames)
+		if ew != nil {
+			return ew
+		}
+	}
+	return nil
+}
+
+// newRenderer creates a renderer that renders at rate and reads
+// the sample files in pool, a map from sample name to path.
+// Only WAV files are decoded, samples in other formats are
+// skipped.
+func newRenderer(rate int, pool map[string]string) *renderer {
+	load := func(name string) (*audioBuffer, error) {
+		path, exists := pool[name]
+		if !exists {
+			return nil, fmt.Errorf("sample %s does not exist", name)
+		}
+		if sampleFormat(path) != "wav" {
+			return nil, nil
+		}
+		file, eo := os.Open(path)
+		if eo != nil {
+			return nil, eo
+		}
+		defer file.Close()
+		buf, er := readWav(file)
+		if er != nil {
+			return nil, fmt.Errorf("sample %s: %s", name, er)
+		}
+		return buf, nil
+	}
+	return &renderer{rate, load, make(map[string]*audioBuffer)}
+}
+
+// renderBank returns the mixdown of the patterns of a bank that
+// req selects
+func renderBank(bank *Bank, req *RenderRequest, pool map[string]string) (*mixdown, error) {
+	patterns := []*Pattern{bank.find(req.Pattern)}
+	if req.Song {
+		patterns = bank.arrangement()
+		if len(patterns) == 0 {
+			return nil, errors.New("there is no song")
+		}
+	} else if patterns[0] == nil {
+		return nil, fmt.Errorf("pattern %s does not exist", req.Pattern)
+	}
+	tempo, rate := bank.Tempo, defaultRate
+	if req.Tempo != 0 {
+		tempo = req.Tempo
+	}
+	if req.Rate != 0 {
+		rate = req.Rate
+	}
+	if rate < minRenderRate || rate > maxRenderRate {
+		str := "sample rate (%d) must be from %d to %d"
+		return nil, fmt.Errorf(str, rate, minRenderRate, maxRenderRate)
+	}
+	if tempo < minRenderTempo || tempo > maxRenderTempo {
+		str := "tempo (%g) must be from %d to %d"
+		return nil, fmt.Errorf(str, tempo, minRenderTempo, maxRenderTempo)
+	}
+	return newRenderer(rate, pool).score(patterns, tempo)
+}
+
+// render returns an http handler that renders a pattern or the
+// song (POST) to a WAV file, as selected by a JSON RenderRequest.
+// The file is written as it is mixed and can be at most
+// maxRenderFrames long. The samples that were skipped because
+// they could not be decoded are listed in the skippedHeader.
+func (self *server) render() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		var md *mixdown
+		req := new(RenderRequest)
+		status := http.StatusBadRequest
+		if r.Method != "POST" {
+			err = errors.New("method not allowed")
+			status = http.StatusMethodNotAllowed
+		} else {
+			err = json.NewDecoder(r.Body).Decode(req)
+			if err == nil {
+				md, err = renderBank(self.seq.Bank(), req, self.samples.paths())
+			}
+			if err == nil && md.length > maxRenderFrames {
+				str := "render of %d frames is longer than %d frames"
+				err = fmt.Errorf(str, md.length, maxRenderFrames)
+				status = http.StatusRequestEntityTooLarge
+			}
+			if err == nil {
+				w.Header().Set("Content-Type", "audio/wav")
+				for _, name := range md.skipped {
+					w.Header().Add(skippedHeader, name)
+				}
+				ew := md.writeWav(w)
+				if ew != nil {
+					// the status code was sent with the header
+					log.Println("could not write render:", ew)
+				}
+				return
+			}
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+	}
+}
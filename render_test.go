@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// constant returns a buffer of n frames of value at 8000 Hz
+func constant(n int, value float32) *audioBuffer {
+	buf := &audioBuffer{8000, make([][2]float32, n)}
+	for i := range buf.frames {
+		buf.frames[i] = [2]float32{value, value}
+	}
+	return buf
+}
+
+// testRenderer renders at 8000 Hz with samples held in memory
+func testRenderer(samples map[string]*audioBuffer) *renderer {
+	return &renderer{8000, nil, samples}
+}
+
+func TestWav(t *testing.T) {
+	buf := &audioBuffer{22050, [][2]float32{{0, 0.5}, {-1, 2}}}
+	out := new(bytes.Buffer)
+	err := writeWav(out, buf)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, out.Len(), 44+8)
+	read, err := readWav(out)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, read.rate, 22050)
+	// 16 bit samples are clipped and rounded
+	assert.Equal(t, read.frames[0], [2]float32{0, 16384.0 / 32768})
+	assert.Equal(t, read.frames[1], [2]float32{-32767.0 / 32768, 32767.0 / 32768})
+
+	// 8 bit mono with an odd sized chunk before the data
+	mono := []byte("RIFF\x00\x00\x00\x00WAVE" +
+		"LIST\x01\x00\x00\x00x\x00" +
+		"fmt \x10\x00\x00\x00\x01\x00\x01\x00\x40\x1f\x00\x00\x40\x1f\x00\x00\x01\x00\x08\x00" +
+		"data\x02\x00\x00\x00\x80\xc0")
+	read, err = readWav(bytes.NewReader(mono))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, read.rate, 8000)
+	assert.Equal(t, read.frames, [][2]float32{{0, 0}, {0.5, 0.5}})
+
+	_, err = readWav(strings.NewReader("fLaC"))
+	assert.Equal(t, err.Error(), "not a wav file")
+	adpcm := bytes.Replace(mono, []byte("\x01\x00\x01\x00\x40"), []byte("\x02\x00\x01\x00\x40"), 1)
+	_, err = readWav(bytes.NewReader(adpcm))
+	assert.Equal(t, err.Error(), "wav format 2 with 8 bits is not supported")
+}
+
+func TestRender(t *testing.T) {
+	rdr := testRenderer(map[string]*audioBuffer{
+		"click": constant(4, 0.5),
+		"pad":   constant(3000, 1),
+	})
+	pat := NewPattern(4)
+	pat.AddTo(1, NewNote("click", 60, 127))
+	// an octave up plays the sample twice as fast
+	pat.AddTo(2, NewNote("click", 72, 127))
+	pad := NewNote("pad", 60, 127)
+	pad.Duration = 1
+	pat.AddTo(3, pad)
+
+	// a step of sixteenths at 120 bpm is 1000 frames
+	buf, err := rdr.render([]*Pattern{pat}, 120)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(buf.frames), 4000)
+	assert.Equal(t, buf.frames[999], [2]float32{0, 0})
+	assert.Equal(t, buf.frames[1003], [2]float32{0.5, 0.5})
+	assert.Equal(t, buf.frames[1004], [2]float32{0, 0})
+	assert.Equal(t, buf.frames[2001], [2]float32{0.5, 0.5})
+	assert.Equal(t, buf.frames[2002], [2]float32{0, 0})
+	assert.Equal(t, buf.frames[3999], [2]float32{1, 1})
+
+	// velocity sets the gain
+	pat.Clear(3)
+	pat.AddTo(0, NewNote("click", 60, 0))
+	pat.AddTo(0, NewNote("pad", 60, 64))
+	buf, _ = rdr.render([]*Pattern{pat, pat}, 240)
+	assert.Equal(t, len(buf.frames), 4000)
+	gain := float32(64) / 127
+	assert.Equal(t, buf.frames[0][0], gain)
+	// notes without a duration play until the sample ends,
+	// mixing with the notes of the next pattern
+	assert.Equal(t, buf.frames[2999][0], 2*gain)
+	assert.Equal(t, buf.frames[3002][0], gain)
+
+	_, err = rdr.render([]*Pattern{pat}, 0)
+	assert.Equal(t, err.Error(), "tempo (0) must be positive")
+}
+
+func TestRenderStream(t *testing.T) {
+	rdr := testRenderer(map[string]*audioBuffer{
+		"click": constant(4, 0.5),
+		"pad":   constant(3000, 0.25),
+	})
+	pat := NewPattern(16)
+	pat.AddTo(0, NewNote("click", 60, 127))
+	// plays across the end of the first chunk
+	pat.AddTo(7, NewNote("pad", 60, 127))
+	pat.AddTo(8, NewNote("pad", 67, 100))
+	// rings past the end of the pattern
+	pat.AddTo(15, NewNote("pad", 48, 127))
+
+	// the mixdown is written a chunk at a time
+	md, err := rdr.score([]*Pattern{pat}, 120)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, md.length > renderChunk, true)
+	streamed := new(bytes.Buffer)
+	err = md.writeWav(streamed)
+	assert.Equal(t, err, nil)
+	buf, err := rdr.render([]*Pattern{pat}, 120)
+	assert.Equal(t, err, nil)
+	mixed := new(bytes.Buffer)
+	writeWav(mixed, buf)
+	assert.Equal(t, streamed.Len(), 44+16000*4)
+	assert.Equal(t, streamed.Bytes(), mixed.Bytes())
+}
+
+func TestServerRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file, err := os.Create(filepath.Join(dir, "click.wav"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeWav(file, constant(4, 0.5))
+	file.Close()
+
+	srv := newTestServer(t)
+	srv.samples.readSamples(dir)
+	srv.seq.AddTo("", 0, NewNote("click", 60, 127))
+
+	req, _ := http.NewRequest("POST", "/render", strings.NewReader(`{"rate":8000}`))
+	w := httptest.NewRecorder()
+	srv.render()(w, req)
+	assert.Equal(t, w.Code, http.StatusOK)
+	buf, err := readWav(w.Body)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(buf.frames), 16000)
+	assert.Equal(t, buf.frames[3][0] > 0.49, true)
+
+	// samples that can not be decoded are skipped
+	ioutil.WriteFile(filepath.Join(dir, "snare.flac"), flacHeader(8000, 2, 16, 441), 0644)
+	srv.samples.readSamples(dir)
+	srv.seq.AddTo("", 4, NewNote("snare", 60, 127))
+	req, _ = http.NewRequest("POST", "/render", strings.NewReader(`{"rate":8000}`))
+	w = httptest.NewRecorder()
+	srv.render()(w, req)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header()[skippedHeader], []string{"snare"})
+	srv.seq.Clear("", 4)
+
+	srv.seq.AddTo("", 4, NewNote("missing", 60, 127))
+	req, _ = http.NewRequest("POST", "/render", strings.NewReader(`{"rate":8000}`))
+	w = httptest.NewRecorder()
+	srv.render()(w, req)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+	assert.Equal(t, w.Body.String(), "sample missing does not exist")
+	srv.seq.Clear("", 4)
+
+	failures := map[string]int{
+		`{"rate":1}`:               http.StatusBadRequest,
+		`{"rate":1000000}`:         http.StatusBadRequest,
+		`{"tempo":1}`:              http.StatusBadRequest,
+		`{"tempo":100000}`:         http.StatusBadRequest,
+		`{"tempo":20,"rate":8000}`: http.StatusOK,
+		`{"tempo":`:                http.StatusBadRequest,
+	}
+	for body, status := range failures {
+		req, _ = http.NewRequest("POST", "/render", strings.NewReader(body))
+		w = httptest.NewRecorder()
+		srv.render()(w, req)
+		assert.Equal(t, w.Code, status)
+	}
+
+	// renders that are too long are refused before they are mixed
+	srv.seq.CreatePattern("long", 4096)
+	req, _ = http.NewRequest("POST", "/render", strings.NewReader(`{"pattern":"long","tempo":20,"rate":192000}`))
+	w = httptest.NewRecorder()
+	srv.render()(w, req)
+	assert.Equal(t, w.Code, http.StatusRequestEntityTooLarge)
+}
@@ -7,118 +7,211 @@ import (
 	"github.com/lightning/lightning"
 	"golang.org/x/net/websocket"
 	"io"
-	"net/http"
+	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // samples manages the sample pool
 type samples struct {
 	// engine plays back samples
-	engine lightning.Engine
+	engine engine
+	// dir is the directory the samples are read from
+	dir string
 	// pool is a map from name => path
 	pool map[string]string
+	// files are the sample files by name
+	files map[string]*sampleFile
+	// tags are the user's tags by sample name
+	tags map[string][]string
+	// tagsPath is the file tags are saved to, tags are
+	// not saved if it is empty
+	tagsPath string
+	// regions are the regions of samples by name, which
+	// are saved to regionsFile in dir
+	regions map[string]*Region
+	// mu guards pool, files, tags and regions, which change when
+	// dir is rescanned while samples are played
+	mu sync.Mutex
+	// scanning serializes rescans of dir
+	scanning sync.Mutex
 }
 
-// response is a response object in the websocket API
-type response struct {
-	success bool   `json:"success"`
-	message string `json:"message,omitempty"`
+// sampleFile is a file in the sample directory
+type sampleFile struct {
+	// path is the path of the file relative to the
+	// sample directory, separated by slashes
+	path string
+	// stat tells a renamed file from a new one
+	// when the directory is rescanned
+	stat os.FileInfo
+	info SampleInfo
 }
 
-// writeJSON writes a response as JSON to an io.Writer
-func (self response) writeJSON(w io.Writer) {
-	enc := json.NewEncoder(w)
-	err := enc.Encode(self)
-	if err != nil {
-		w.Write([]byte("Could not write response"))
-	}
+// unchanged returns true if the file at path with stat is
+// the file that was scanned, so its header is not read again
+func (self *sampleFile) unchanged(path string, stat os.FileInfo) bool {
+	return self.path == path && os.SameFile(self.stat, stat) &&
+		self.stat.Size() == stat.Size() && self.stat.ModTime().Equal(stat.ModTime())
 }
 
-// writeJSON writes samples in json format to an io.Writer
-func (self *samples) writeJSON(w io.Writer) error {
-	enc := json.NewEncoder(w)
-	samples := make([]string, len(self.pool))
-	i := 0
-	// key is sample name, value is path to file
-	for name, _ := range self.pool {
-		samples[i] = name
-		i += 1
-	}
-	return enc.Encode(samples)
+// lookup returns the path of the sample with a name
+func (self *samples) lookup(name string) (string, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	samplePath, exists := self.pool[name]
+	return samplePath, exists
 }
 
-// list returns an http handler that lists samples
-func (self *samples) list() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		err := self.writeJSON(w)
-		if err != nil {
-			// assume status code is not already sent
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-		}
+// paths returns a copy of the pool
+func (self *samples) paths() map[string]string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pool := make(map[string]string, len(self.pool))
+	for name, samplePath := range self.pool {
+		pool[name] = samplePath
 	}
+	return pool
 }
 
-// play returns an http handler that plays a sample
+// play returns a websocket handler that plays samples in the pool
 func (self *samples) play() websocket.Handler {
 	return func(conn *websocket.Conn) {
-		for {
-			note, err := lightning.ReadNote(conn)
-			if err == io.EOF {
-				continue
+		serveNotes(conn, func(note *lightning.Note) Response {
+			samplePath, exists := self.lookup(note.Sample)
+			if !exists {
+				msg := fmt.Sprintf("sample %s does not exist", note.Sample)
+				return Response{"", "error", msg, codeNotFound}
 			}
+			note.Sample = samplePath
+			err := self.engine.PlayNote(note)
 			if err != nil {
-				response{false, err.Error()}.writeJSON(conn)
-				return
-			}
-			if samplePath, exists := self.pool[note.Sample]; !exists {
-				msg := fmt.Sprintf("sample %s does not exist", samplePath)
-				response{false, msg}.writeJSON(conn)
-				return
-			} else {
-				note.Sample = samplePath
+				return errorResponse("", err, codeEngine)
 			}
-			err = self.engine.PlayNote(note)
-			if err != nil {
-				response{false, err.Error()}.writeJSON(conn)
-			}
-			response{true, "played " + note.Sample}.writeJSON(conn)
+			return Response{"", "ok", "played " + note.Sample, ""}
+		})
+	}
+}
+
+// serveNotes reads a note from every message sent to conn and
+// answers it with the Response play returns, until the client
+// closes the connection. Messages that are not notes are answered
+// with an error Response.
+func serveNotes(conn *websocket.Conn, play func(note *lightning.Note) Response) {
+	for {
+		var msg []byte
+		err := websocket.Message.Receive(conn, &msg)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("could not read from %s: %s\n", conn.Request().RemoteAddr, err)
+			return
+		}
+		var res Response
+		note := new(lightning.Note)
+		err = json.Unmarshal(msg, note)
+		if err != nil {
+			res = errorResponse("", err, codeMalformed)
+		} else {
+			res = play(note)
+		}
+		err = res.writeJSON(conn)
+		if err != nil {
+			log.Printf("could not write to %s: %s\n", conn.Request().RemoteAddr, err)
+			return
 		}
 	}
 }
 
-// readSamples reads samples from a directory
+// readSamples reads samples and their regions from a
+// directory, which is read again by rescan
 func (self *samples) readSamples(dir string) error {
-	fh, eo := os.Open(dir)
-	if eo != nil {
-		return eo
+	self.mu.Lock()
+	self.dir = dir
+	self.mu.Unlock()
+	err := self.readRegions()
+	if err != nil {
+		return err
 	}
+	_, err = self.rescan()
+	if err != nil {
+		return err
+	}
+	if len(self.paths()) == 0 {
+		return errors.New("no samples in " + dir)
+	}
+	return nil
+}
+
+// scanSamples returns the sample files in a directory and its
+// subdirectories by name. The name of a sample is its path relative
+// to dir without its extension. The header of a file is only read
+// if it is not in old or has changed since old was scanned. Hidden
+// files and directories are skipped.
+func scanSamples(dir string, old map[string]*sampleFile) (map[string]*sampleFile, error) {
 	// determine if it is a directory
-	info, es := fh.Stat()
+	info, es := os.Stat(dir)
 	if es != nil {
-		return es
+		return nil, es
 	}
 	if !info.IsDir() {
-		return errors.New(dir + " is not a directory")
-	}
-	fs, er := fh.Readdir(1024)
-	if er == io.EOF {
-		return errors.New("no samples in " + dir)
+		return nil, errors.New(dir + " is not a directory")
 	}
-	for _, f := range fs {
-		if isSupported(f.Name()) {
-			name := getName(f.Name())
-			self.pool[name] = path.Join(dir, f.Name())
+	files := make(map[string]*sampleFile)
+	ew := filepath.Walk(dir, func(f string, stat os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f != dir && strings.HasPrefix(stat.Name(), ".") {
+			if stat.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if stat.IsDir() || !isSupported(stat.Name()) {
+			return nil
 		}
+		rel, err := filepath.Rel(dir, f)
+		if err != nil {
+			return err
+		}
+		file := &sampleFile{path: filepath.ToSlash(rel), stat: stat}
+		name := strings.TrimSuffix(file.path, path.Ext(file.path))
+		prev, exists := old[name]
+		if exists && prev.unchanged(file.path, stat) {
+			file.info = prev.info
+		} else {
+			file.info, err = readSampleInfo(f)
+			if err != nil {
+				log.Printf("could not read %s: %s\n", f, err)
+			}
+			file.info.Name, file.info.Folder = name, path.Dir(name)
+			if file.info.Folder == "." {
+				file.info.Folder = ""
+			}
+		}
+		files[name] = file
+		return nil
+	})
+	if ew != nil {
+		return nil, ew
 	}
-	return nil
+	return files, nil
 }
 
 // newSamples creates a new samples object
-func newSamples(engine lightning.Engine) *samples {
-	return &samples{engine, make(map[string]string, 0)}
+func newSamples(engine engine) *samples {
+	return &samples{
+		engine:  engine,
+		pool:    make(map[string]string, 0),
+		files:   make(map[string]*sampleFile),
+		tags:    make(map[string][]string),
+		regions: make(map[string]*Region),
+	}
 }
 
 // supportedExtensions is a whitelist of file extensions that we support
@@ -133,11 +226,3 @@ func isSupported(f string) bool {
 	}
 	return false
 }
-
-// getName gets the sample name from the path to the
-// sample file. The sample name is the base name stripped of
-// the file extension.
-func getName(f string) string {
-	base := path.Base(f)
-	return base[0:strings.LastIndex(base, ".")]
-}
@@ -1,3 +1,30 @@
 package main
 
+import (
+	"github.com/bmizerany/assert"
+	"net/http/httptest"
+	"testing"
+)
 
+func TestSamplesPlay(t *testing.T) {
+	engine := newNullEngine()
+	smp := newSamples(engine)
+	smp.pool["kick"] = "/samples/kick.wav"
+	ts := httptest.NewServer(smp.play())
+	defer ts.Close()
+	conn := dial(t, ts)
+	defer conn.Close()
+
+	res := roundTrip(t, conn, `{"sample":"kick","number":60,"velocity":100}`)
+	assert.Equal(t, res, Response{"", "ok", "played /samples/kick.wav", ""})
+	assert.Equal(t, engine.Played()[0].Note.Sample, "/samples/kick.wav")
+
+	res = roundTrip(t, conn, `{"sample":"snare"}`)
+	assert.Equal(t, res, Response{"", "error", "sample snare does not exist", codeNotFound})
+	res = roundTrip(t, conn, `kick`)
+	assert.Equal(t, res.Code, codeMalformed)
+	engine.Close()
+	res = roundTrip(t, conn, `{"sample":"kick"}`)
+	assert.Equal(t, res.Code, codeEngine)
+	assert.Equal(t, len(engine.Played()), 1)
+}
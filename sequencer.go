@@ -1,96 +1,698 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/lightning/lightning"
-	"github.com/lightning/metro"
+	"log"
+	"sync"
+	"time"
 )
 
+// defaultPattern is the name of the pattern
+// a new sequencer starts with
+const defaultPattern = "main"
+
+// noteStopper is implemented by engines that can stop
+// a note before its sample ends. The duration of notes is
+// ignored by engines that do not implement it.
+type noteStopper interface {
+	StopNote(note *lightning.Note) error
+}
+
+// pendingStop is a playing note that will be stopped
+// when the sequencer has played tick steps
+type pendingStop struct {
+	tick uint64
+	note *lightning.Note
+}
+
 // sequencer provides a way to play a Pattern using timing
-// events emitted from a Metro
+// events emitted from a clock
 type sequencer struct {
-	PosChan    chan uint64
 	PlayErrors chan error
-	engine     lightning.Engine
-	metro      metro.Metro
-	pattern    *Pattern `json:"pattern"`
+	engine     engine
+	clock      clock
+	// lookup returns the file the engine plays for a sample
+	// or region in the pool, notes are played with the names
+	// in the pattern if it is nil
+	lookup func(name string) (string, bool)
+	// tempo is the tempo in beats per minute, where the beat
+	// is the unit of the playing pattern's meter
+	tempo float32
+	// patterns is the pattern bank, in the order clients display it
+	patterns []*Pattern
+	// pattern is the playing pattern
+	pattern *Pattern
+	// next is the pattern that will play from the next bar
+	next *Pattern
+	// song is the arrangement the sequencer walks through
+	song []SongEntry
+	// songPos is the index of the playing song entry,
+	// or -1 if the sequencer is not following the song
+	songPos int
+	// repeats counts how many times the playing song entry
+	// has been played
+	repeats int
+	// pos is the next position to play in pattern
+	pos uint64
+	// played is the location of the last position played
+	played Location
+	// ticks counts the steps that have been played
+	ticks uint64
+	// stops are the notes that will be stopped when their
+	// duration has elapsed
+	stops []pendingStop
+	// cue counts the times the transport stopped or the playing
+	// pattern was replaced, notes delayed before then are dropped
+	cue uint64
+	// edits counts the changes made to patterns, the song
+	// and the tempo
+	edits uint64
+	// history is the undo and redo history of note edits
+	history journal
+	// listeners receive every position that is played
+	listeners map[chan uint64]bool
+	// mu guards the patterns, which are edited by websocket
+	// clients while the clock plays them,
+	// the song, and listeners
+	mu sync.Mutex
 }
 
-// newSequencer creates a Sequencer
-func newSequencer(engine lightning.Engine, patternSize int, tempo float32) *sequencer {
+// newSequencer creates a Sequencer that plays a step
+// for every tick of clock
+func newSequencer(engine engine, clock clock, patternSize int, tempo float32) *sequencer {
 	seq := new(sequencer)
-	seq.PosChan = make(chan uint64)
+	seq.listeners = make(map[chan uint64]bool)
 	seq.PlayErrors = make(chan error)
 	seq.engine = engine
 	seq.pattern = NewPattern(patternSize)
-	seq.metro = metro.New(tempo)
-
-	go func() {
-		for tick := range seq.metro.Ticks() {
-			pos := tick % uint64(seq.pattern.Length)
-			seq.PosChan <- pos
-			err := seq.PlayNotesAt(tick)
-			if err != nil {
-				// Crash if sample playback errors are not handled!
-				select {
-				case seq.PlayErrors <- err:
-				default:
-					panic(err)
-				}
-			}
+	seq.pattern.Name = defaultPattern
+	seq.patterns = []*Pattern{seq.pattern}
+	seq.songPos = -1
+	seq.played = seq.pattern.Locate(0)
+	seq.tempo = tempo
+	seq.clock = clock
+	seq.clock.SetTempo(seq.metroTempo())
+	seq.clock.Run(func() {
+		err := seq.step()
+		if err != nil {
+			seq.playError(err)
 		}
-	}()
+	})
 
 	return seq
 }
 
-// Play plays all the notes stored at pos
-func (self *sequencer) PlayNotesAt(pos uint64) error {
+// playError reports an error playing a note on PlayErrors,
+// or logs it if nothing is receiving from PlayErrors
+func (self *sequencer) playError(err error) {
+	select {
+	case self.PlayErrors <- err:
+	default:
+		log.Printf("could not play note: %s\n", err)
+	}
+}
+
+// Subscribe returns a channel that receives the positions
+// played by the sequencer. The channel only holds the latest
+// position, so a slow listener skips positions rather than
+// stalling playback.
+func (self *sequencer) Subscribe() chan uint64 {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	c := make(chan uint64, 1)
+	self.listeners[c] = true
+	return c
+}
+
+// Unsubscribe stops sending positions to a channel
+// returned by Subscribe.
+func (self *sequencer) Unsubscribe(c chan uint64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.listeners, c)
+}
+
+// sendPosition sends pos to every listener without blocking.
+// If a listener has not read the previous position it is
+// replaced with pos. The caller must hold mu.
+func (self *sequencer) sendPosition(pos uint64) {
+	for c, _ := range self.listeners {
+		select {
+		case <-c:
+		default:
+		}
+		select {
+		case c <- pos:
+		default:
+		}
+	}
+}
+
+// step plays the notes at the current position in the
+// playing pattern and moves to the next position.
+func (self *sequencer) step() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.sendPosition(self.pos)
+	self.played = self.pattern.Locate(self.pos)
+	// stop notes before playing new ones, so a note that
+	// is retriggered as it ends is not cut off
+	es := self.stopNotes(self.ticks)
+	delay, scale := self.pattern.feel(self.pos)
+	notes, el := self.resolve(self.pattern.mix(self.pattern.NotesAt(self.pos)))
+	for _, note := range notes {
+		note.Velocity = scaleVelocity(note.Velocity, scale)
+	}
+	ep := self.playNotes(notes, time.Duration(delay*float64(self.stepDuration())))
+	if ep == nil {
+		ep = el
+	}
+	self.advance()
+	self.ticks += 1
+	if es != nil {
+		return es
+	}
+	return ep
+}
+
+// advance moves to the next position. A pending pattern switch
+// happens at the next bar boundary or at the end of a loop, a pattern
+// with a loop jumps back to the start of the loop at its end, and when the playing pattern
+// ends the sequencer moves through the song, if it is following one.
+// The caller must hold mu.
+func (self *sequencer) advance() {
+	self.pos += 1
+	bar := uint64(self.pattern.meter().BarLength())
+	loop := self.pattern.Loop
+	looped := loop != nil && (self.pos < loop.Start || self.pos >= loop.End)
+	if self.next != nil && (looped || self.pos%bar == 0) {
+		self.switchTo(self.next)
+		return
+	}
+	if loop != nil {
+		// a looping pattern never ends, so the song waits
+		// until the loop is removed
+		if looped {
+			self.pos = loop.Start
+		}
+		return
+	}
+	if self.pos < uint64(self.pattern.Length) {
+		return
+	}
+	self.pos = 0
+	if self.songPos < 0 {
+		return
+	}
+	self.repeats += 1
+	if self.repeats < self.song[self.songPos].Repeat {
+		return
+	}
+	self.songPos = (self.songPos + 1) % len(self.song)
+	self.repeats = 0
+	self.switchTo(self.find(self.song[self.songPos].Pattern))
+}
+
+// switchTo plays pat from its first position, which is the
+// start of its loop if it has one. If pat divides
+// its beats into a different number of steps than the playing
+// pattern, the clock is sped up or slowed down so that the
+// tempo stays the same. The caller must hold mu.
+func (self *sequencer) switchTo(pat *Pattern) {
+	steps := self.pattern.meter().Steps
+	self.pattern, self.next, self.pos = pat, nil, pat.start()
+	self.cue += 1
+	if pat.meter().Steps != steps {
+		self.clock.SetTempo(self.metroTempo())
+	}
+}
+
+// metroTempo returns the tempo the clock has to tick at so that
+// the playing pattern plays at the sequencer's tempo.
+// The caller must hold mu.
+func (self *sequencer) metroTempo() float32 {
+	steps := self.pattern.meter().Steps
+	return self.tempo * float32(steps) / metroSteps
+}
+
+// stepDuration returns the time between two steps at the
+// current tempo. The caller must hold mu.
+func (self *sequencer) stepDuration() time.Duration {
+	steps := self.pattern.meter().Steps
+	return time.Duration(float64(time.Minute) / float64(self.tempo) / float64(steps))
+}
+
+// resolve replaces the sample names of mixed notes with the
+// files the engine plays, see lookup. Notes whose sample is not
+// in the pool are left out and reported in the error.
+// The caller must hold mu.
+func (self *sequencer) resolve(notes []*Note) ([]*Note, error) {
+	if self.lookup == nil {
+		return notes, nil
+	}
 	var err error
-	for _, note := range self.pattern.NotesAt(pos) {
+	resolved := notes[:0]
+	for _, note := range notes {
+		samplePath, exists := self.lookup(note.Sample)
+		if !exists {
+			if err == nil {
+				err = fmt.Errorf("sample %s does not exist", note.Sample)
+			}
+			continue
+		}
+		note.Sample = samplePath
+		resolved = append(resolved, note)
+	}
+	return resolved, err
+}
+
+// playNotes plays notes after delay and schedules a stop for
+// the ones that have a duration if the engine can stop notes.
+// The caller must hold mu.
+func (self *sequencer) playNotes(notes []*Note, delay time.Duration) error {
+	_, gates := self.engine.(noteStopper)
+	for _, note := range notes {
 		if note != nil {
-			err = self.engine.PlayNote(note)
+			err := self.playNote(&note.Note, delay)
 			if err != nil {
 				return err
 			}
+			if gates && note.Duration > 0 {
+				tick := self.ticks + uint64(note.Duration)
+				self.stops = append(self.stops, pendingStop{tick, &note.Note})
+			}
 		}
 	}
 	return nil
 }
 
+// playNote plays a note after delay on the clock. Errors
+// playing delayed notes are reported on PlayErrors. A delayed
+// note is dropped if the transport stops or the playing pattern
+// is replaced before it is due. The caller must hold mu.
+func (self *sequencer) playNote(note *lightning.Note, delay time.Duration) error {
+	if delay <= 0 {
+		return self.engine.PlayNote(note)
+	}
+	cue := self.cue
+	self.clock.AfterFunc(delay, func() {
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		if self.cue != cue {
+			return
+		}
+		err := self.engine.PlayNote(note)
+		if err != nil {
+			self.playError(err)
+		}
+	})
+	return nil
+}
+
+// stopNotes stops the notes that are due to be stopped
+// by tick. The caller must hold mu.
+func (self *sequencer) stopNotes(tick uint64) error {
+	var err error
+	pending := self.stops[:0]
+	for _, stop := range self.stops {
+		if stop.tick > tick {
+			pending = append(pending, stop)
+			continue
+		}
+		es := self.stopNote(stop.note)
+		if err == nil {
+			err = es
+		}
+	}
+	self.stops = pending
+	return err
+}
+
+// stopNote stops a playing note, stops are only scheduled
+// if the engine is a noteStopper. The caller must hold mu.
+func (self *sequencer) stopNote(note *lightning.Note) error {
+	return self.engine.(noteStopper).StopNote(note)
+}
+
+// find returns the pattern with the given name, or nil.
+// An empty name means the playing pattern.
+// The caller must hold mu.
+func (self *sequencer) find(name string) *Pattern {
+	if name == "" {
+		return self.pattern
+	}
+	for _, pat := range self.patterns {
+		if pat.Name == name {
+			return pat
+		}
+	}
+	return nil
+}
+
+// edit calls fn with the named pattern, and counts the
+// edit if fn succeeds.
+func (self *sequencer) edit(name string, fn func(pat *Pattern) error) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pat := self.find(name)
+	if pat == nil {
+		return fmt.Errorf("pattern %s does not exist", name)
+	}
+	err := fn(pat)
+	if err == nil {
+		self.edits += 1
+	}
+	return err
+}
+
 // NotesAt returns a slice representing the notes
 // that are stored at a particular position in the
-// sequencer's Pattern.
-func (self *sequencer) NotesAt(pos uint64) []*lightning.Note {
-	return self.pattern.NotesAt(pos)
+// named Pattern. An empty name means the playing pattern.
+func (self *sequencer) NotesAt(name string, pos uint64) []*Note {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pat := self.find(name)
+	if pat == nil {
+		return nil
+	}
+	return pat.NotesAt(pos)
+}
+
+// editNotes calls fn to edit the notes at pos in the named
+// pattern, and records the edit in the history if fn succeeds.
+func (self *sequencer) editNotes(name string, pos uint64, fn func(pat *Pattern) error) error {
+	return self.edit(name, func(pat *Pattern) error {
+		before := snapshot(pat, pos)
+		err := fn(pat)
+		if err == nil {
+			self.history.record(journalEntry{pat.Name, pos, before, snapshot(pat, pos)})
+		}
+		return err
+	})
+}
+
+// Length returns the length of the named pattern.
+func (self *sequencer) Length(name string) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pat := self.find(name)
+	if pat == nil {
+		return 0, fmt.Errorf("pattern %s does not exist", name)
+	}
+	return pat.Length, nil
+}
+
+// Meter returns the meter of the named pattern.
+func (self *sequencer) Meter(name string) (Meter, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pat := self.find(name)
+	if pat == nil {
+		return Meter{}, fmt.Errorf("pattern %s does not exist", name)
+	}
+	return pat.meter(), nil
 }
 
-// AddTo adds a note to the sequencer's pattern at pos.
-func (self *sequencer) AddTo(pos uint64, note *lightning.Note) error {
-	return self.pattern.AddTo(pos, note)
+// AddTo adds a note to the named pattern at pos.
+func (self *sequencer) AddTo(name string, pos uint64, note *Note) error {
+	return self.editNotes(name, pos, func(pat *Pattern) error {
+		return pat.AddTo(pos, note)
+	})
 }
 
-// AddTo adds a note to the sequencer's pattern at pos.
-func (self *sequencer) RemoveFrom(pos uint64, note *lightning.Note) error {
-	return self.pattern.RemoveFrom(pos, note)
+// RemoveFrom removes a note from the named pattern at pos.
+func (self *sequencer) RemoveFrom(name string, pos uint64, note *Note) error {
+	return self.editNotes(name, pos, func(pat *Pattern) error {
+		return pat.RemoveFrom(pos, note)
+	})
 }
 
 // Clear removes all the notes at a given position
-// in the sequencer's Pattern.
-func (self *sequencer) Clear(pos uint64) error {
-	return self.pattern.Clear(pos)
+// in the named Pattern.
+func (self *sequencer) Clear(name string, pos uint64) error {
+	return self.editNotes(name, pos, func(pat *Pattern) error {
+		return pat.Clear(pos)
+	})
+}
+
+// AddTrack adds a track to the named pattern.
+func (self *sequencer) AddTrack(name string, track *Track) error {
+	return self.edit(name, func(pat *Pattern) error {
+		return pat.AddTrack(track)
+	})
+}
+
+// SetTrack replaces a track in the named pattern, e.g.
+// to mute it or change its gain.
+func (self *sequencer) SetTrack(name string, index int, track *Track) error {
+	return self.edit(name, func(pat *Pattern) error {
+		return pat.SetTrack(index, track)
+	})
+}
+
+// DeleteTrack removes a track and its notes from the named pattern.
+func (self *sequencer) DeleteTrack(name string, index int) error {
+	return self.edit(name, func(pat *Pattern) error {
+		err := pat.DeleteTrack(index)
+		if err == nil {
+			self.history.forget(pat.Name)
+		}
+		return err
+	})
+}
+
+// Events returns the notes in the named Pattern as Events.
+func (self *sequencer) Events(name string) ([]Event, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pat := self.find(name)
+	if pat == nil {
+		return nil, fmt.Errorf("pattern %s does not exist", name)
+	}
+	return pat.Events(), nil
+}
+
+// SetEvents replaces all the notes in the named Pattern,
+// which is undone in a single step.
+// If any of the events can not be added the Pattern is
+// left unchanged.
+func (self *sequencer) SetEvents(name string, events []Event) error {
+	return self.edit(name, func(pat *Pattern) error {
+		notes := NewPattern(pat.Length)
+		notes.Tracks = pat.Tracks
+		for _, ev := range events {
+			if ev.Note == nil {
+				return fmt.Errorf("event at pos %d has no note", ev.Pos)
+			}
+			err := notes.AddTo(ev.Pos, ev.Note)
+			if err != nil {
+				return err
+			}
+		}
+		entries := make([]journalEntry, 0)
+		for pos := range pat.Notes {
+			before, after := pat.Notes[pos], notes.Notes[pos]
+			if len(before) > 0 || len(after) > 0 {
+				entries = append(entries, journalEntry{pat.Name, uint64(pos), before, after})
+			}
+		}
+		self.history.recordAll(entries)
+		pat.Notes = notes.Notes
+		return nil
+	})
+}
+
+// Batch calls fn and records the note edits it makes as a
+// single step in the history, so they are undone together.
+// If fn returns an error, the edits it made are reverted.
+// fn must not call Batch.
+func (self *sequencer) Batch(fn func() error) error {
+	self.mu.Lock()
+	self.history.begin()
+	self.mu.Unlock()
+	err := fn()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if err != nil {
+		self.restore(self.history.cancel(), true)
+		return err
+	}
+	self.history.end()
+	return nil
+}
+
+// Undo reverts the last step in the history and
+// returns the positions it changed.
+func (self *sequencer) Undo() ([]Change, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	n := len(self.history.undo)
+	if n == 0 {
+		return nil, errors.New("nothing to undo")
+	}
+	step := self.history.undo[n-1]
+	self.history.undo = self.history.undo[:n-1]
+	self.history.redo = append(self.history.redo, step)
+	return self.restore(step, true), nil
+}
+
+// Redo makes the last step that was undone again and
+// returns the positions it changed.
+func (self *sequencer) Redo() ([]Change, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	n := len(self.history.redo)
+	if n == 0 {
+		return nil, errors.New("nothing to redo")
+	}
+	step := self.history.redo[n-1]
+	self.history.redo = self.history.redo[:n-1]
+	self.history.undo = append(self.history.undo, step)
+	return self.restore(step, false), nil
+}
+
+// SetNotes replaces the notes at the positions of changes,
+// e.g. to replay an undo from the session log. The changes
+// are not recorded in the history.
+func (self *sequencer) SetNotes(changes []Change) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, change := range changes {
+		pat := self.find(change.Pattern)
+		if pat == nil {
+			return fmt.Errorf("pattern %s does not exist", change.Pattern)
+		}
+		if change.Pos >= uint64(pat.Length) {
+			return pat.indexTooLarge(change.Pos)
+		}
+	}
+	for _, change := range changes {
+		pat := self.find(change.Pattern)
+		pat.Notes[change.Pos] = append([]*Note(nil), change.Notes...)
+	}
+	self.edits += 1
+	return nil
+}
+
+// restore sets the notes of a step in the history back to
+// how they were before the step was made, or to how they
+// were after it. The caller must hold mu.
+func (self *sequencer) restore(step []journalEntry, undo bool) []Change {
+	changes := make([]Change, 0, len(step))
+	for i := range step {
+		entry := step[i]
+		notes := entry.after
+		if undo {
+			// undo the entries of a step in reverse
+			entry = step[len(step)-1-i]
+			notes = entry.before
+		}
+		pat := self.find(entry.pattern)
+		if pat == nil || entry.pos >= uint64(pat.Length) {
+			continue
+		}
+		pat.Notes[entry.pos] = append([]*Note(nil), notes...)
+		changes = append(changes, Change{entry.pattern, entry.pos, notes})
+	}
+	if len(changes) > 0 {
+		self.edits += 1
+	}
+	return changes
+}
+
+// Edits returns the number of changes that have been
+// made to the sequencer's patterns, song and tempo.
+func (self *sequencer) Edits() uint64 {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.edits
 }
 
 // Start plays the sequencer's Pattern.
 func (self *sequencer) Start() error {
-	return self.metro.Start()
+	return self.clock.Start()
 }
 
 // Stop playing the sequencer's Pattern.
+// Notes that have a duration are stopped right away.
 func (self *sequencer) Stop() error {
-	return self.metro.Stop()
+	err := self.clock.Stop()
+	if err != nil {
+		return err
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.cue += 1
+	return self.stopNotes(^uint64(0))
 }
 
 // SetTempo sets the tempo in bpm and returns the old tempo
 func (self *sequencer) SetTempo(bpm float32) float32 {
-	return self.metro.SetTempo(bpm)
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	old := self.tempo
+	self.tempo = bpm
+	self.clock.SetTempo(self.metroTempo())
+	self.edits += 1
+	return old
+}
+
+// SetMeter sets the meter of the named pattern.
+func (self *sequencer) SetMeter(name string, meter *Meter) error {
+	return self.edit(name, func(pat *Pattern) error {
+		steps := self.pattern.meter().Steps
+		err := pat.SetMeter(meter)
+		if err == nil && pat == self.pattern && pat.meter().Steps != steps {
+			self.clock.SetTempo(self.metroTempo())
+		}
+		return err
+	})
+}
+
+// SetLoop sets the loop region of the named pattern.
+// A nil loop removes the pattern's loop.
+func (self *sequencer) SetLoop(name string, loop *Loop) error {
+	return self.edit(name, func(pat *Pattern) error {
+		return pat.SetLoop(loop)
+	})
+}
+
+// Resize changes the length of the named pattern. If the
+// playing pattern is truncated before the current position,
+// it plays from its start.
+func (self *sequencer) Resize(name string, length int) error {
+	return self.edit(name, func(pat *Pattern) error {
+		err := pat.Resize(length)
+		if err != nil {
+			return err
+		}
+		self.history.forget(pat.Name)
+		if pat == self.pattern && self.pos >= uint64(length) {
+			self.pos = pat.start()
+		}
+		return nil
+	})
+}
+
+// Position returns the location of the last position played.
+func (self *sequencer) Position() Location {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.played
+}
+
+// SetSwing sets the swing amount of the named pattern.
+func (self *sequencer) SetSwing(name string, swing float64) error {
+	return self.edit(name, func(pat *Pattern) error {
+		return pat.SetSwing(swing)
+	})
+}
+
+// SetGroove sets the groove of the named pattern.
+func (self *sequencer) SetGroove(name string, groove *Groove) error {
+	return self.edit(name, func(pat *Pattern) error {
+		return pat.SetGroove(groove)
+	})
 }
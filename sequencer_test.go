@@ -1,25 +1,131 @@
 package main
 
-import "github.com/lightning/lightning"
-import "testing"
+import (
+	"fmt"
+	"github.com/bmizerany/assert"
+	"github.com/lightning/lightning"
+	"testing"
+)
 
 func TestSequencer(t *testing.T) {
-	engine := lightning.NewEngine()
-	seq := newSequencer(engine, 128, 480)
+	engine := newNullEngine()
+	clock := newVirtualClock()
+	seq := newSequencer(engine, clock, 128, 480)
+	seq.AddTo("", 0, NewNote("kick", 60, 100))
+	seq.AddTo("", 16, NewNote("snare", 60, 100))
 
+	assert.Equal(t, clock.Advance(1).Error(), "clock is not running")
 	err := seq.Start()
 	if err != nil {
 		t.Fatal(err)
 	}
+	err = clock.Advance(17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, seq.Position().Pos, uint64(16))
+	assert.Equal(t, len(engine.Played()), 2)
 
-	for pos := range seq.PosChan {
-		if pos > 16 {
-			break
-		}
+	err = seq.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, clock.Advance(1).Error(), "clock is not running")
+	assert.Equal(t, seq.Position().Pos, uint64(16))
+}
+
+func TestSequencerSubscribe(t *testing.T) {
+	engine := newNullEngine()
+	clock := newVirtualClock()
+	seq := newSequencer(engine, clock, 128, 480)
+
+	// a listener that never reads must not stall playback
+	slow := seq.Subscribe()
+	first, second := seq.Subscribe(), seq.Subscribe()
+
+	err := seq.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for pos := uint64(0); pos < 17; pos++ {
+		clock.Advance(1)
+		assert.Equal(t, <-first, pos)
 	}
+	seq.Unsubscribe(first)
+	// listeners that fall behind get the latest position
+	assert.Equal(t, <-second, uint64(16))
+	seq.Unsubscribe(second)
 
 	err = seq.Stop()
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(slow) != 1 {
+		t.Fatalf("expected slow listener to hold the latest position")
+	}
+}
+
+// stoppingEngine is a nullEngine that records the notes
+// it is asked to stop
+type stoppingEngine struct {
+	*nullEngine
+	stopped []lightning.Note
+}
+
+func (self *stoppingEngine) StopNote(note *lightning.Note) error {
+	self.stopped = append(self.stopped, *note)
+	return nil
+}
+
+// velocities returns the samples and velocities of the notes an
+// engine played
+func velocities(engine *nullEngine) []string {
+	played := make([]string, 0)
+	for _, p := range engine.Played() {
+		played = append(played, fmt.Sprintf("%s %d", p.Note.Sample, p.Note.Velocity))
+	}
+	return played
+}
+
+func TestSequencerNoteDuration(t *testing.T) {
+	engine := &stoppingEngine{newNullEngine(), nil}
+	seq := newSequencer(engine, newVirtualClock(), 16, 120)
+	gated := NewNote("pad.wav", 60, 100)
+	gated.Duration = 3
+	seq.AddTo("", 0, gated)
+	seq.AddTo("", 1, NewNote("kick.wav", 60, 100))
+
+	steps(t, seq, 1)
+	assert.Equal(t, len(seq.stops), 1)
+	assert.Equal(t, seq.stops[0].tick, uint64(3))
+	// one shot notes are never stopped
+	steps(t, seq, 2)
+	assert.Equal(t, len(seq.stops), 1)
+	assert.Equal(t, velocities(engine.nullEngine), []string{"pad.wav 100", "kick.wav 100"})
+	assert.Equal(t, len(engine.stopped), 0)
+	// the note is stopped after 3 steps
+	steps(t, seq, 1)
+	assert.Equal(t, len(seq.stops), 0)
+	assert.Equal(t, engine.stopped, []lightning.Note{gated.Note})
+
+	// stopping the sequencer stops playing notes
+	seq.AddTo("", 4, gated)
+	steps(t, seq, 1)
+	assert.Equal(t, len(seq.stops), 1)
+	seq.Stop()
+	assert.Equal(t, len(seq.stops), 0)
+	assert.Equal(t, engine.stopped, []lightning.Note{gated.Note, gated.Note})
+}
+
+func TestSequencerNoteDurationIgnored(t *testing.T) {
+	engine := newNullEngine()
+	seq := newSequencer(engine, newVirtualClock(), 16, 120)
+	gated := NewNote("pad.wav", 60, 100)
+	gated.Duration = 1
+	seq.AddTo("", 0, gated)
+
+	// engines that can not stop notes play the whole sample
+	steps(t, seq, 2)
+	assert.Equal(t, len(seq.stops), 0)
+	assert.Equal(t, velocities(engine), []string{"pad.wav 100"})
 }
@@ -1,26 +1,108 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/lightning/lightning"
 	"golang.org/x/net/websocket"
 	"io"
+	"log"
+	"net"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 )
 
 const (
-	// our pattern has 16384 sixteenth notes,
-	// which means we have 1024 bars available.
+	// our pattern has 4096 steps, which in the default
+	// meter of 4/4 sixteenths means 256 bars are available.
 	patternLength  = 4096
 	sequencerStop  = 0
 	sequencerStart = 1
 )
 
+// codes of error Responses
+const (
+	// the message is not valid JSON, or is not shaped like a
+	// message the endpoint understands
+	codeMalformed = "malformed"
+	// the command is not one the endpoint understands
+	codeUnknown = "unknown"
+	// the command can not be applied, e.g. because the
+	// pattern it edits does not exist
+	codeInvalid = "invalid"
+	// the sample does not exist
+	codeNotFound = "not_found"
+	// the request conflicts with the server's state, e.g.
+	// it would overwrite a sample
+	codeConflict = "conflict"
+	// the engine could not play the note
+	codeEngine = "engine"
+	// the server failed, e.g. the project could not be saved
+	codeInternal = "internal"
+)
+
+// Response is sent back to websocket clients. ID is the id
+// of the Command being answered, if there is one. Code says
+// why a request failed, it is empty if Status is "ok".
 type Response struct {
+	ID      string `json:"id,omitempty"`
 	Status  string `json:"status"`
 	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
+}
+
+// requestError is an error with the code it is reported with
+type requestError struct {
+	code    string
+	message string
+}
+
+func (self *requestError) Error() string {
+	return self.message
+}
+
+// httpStatus returns the status code an http handler
+// responds with when it fails with err
+func httpStatus(err error) int {
+	if re, ok := err.(*requestError); ok {
+		switch re.code {
+		case codeMalformed, codeUnknown, codeInvalid:
+			return http.StatusBadRequest
+		case codeNotFound:
+			return http.StatusNotFound
+		case codeConflict:
+			return http.StatusConflict
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// respondJSON responds with status and v as JSON. v is encoded
+// before anything is sent, so an error encoding it can still be
+// responded to with an error status. Errors sending the response
+// are not returned, since nothing more can be sent.
+func respondJSON(w http.ResponseWriter, status int, v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(bs, '\n'))
+	return nil
+}
+
+// errorResponse returns the Response that reports err to the
+// client that sent the request with id. err is reported with
+// code unless it is a requestError.
+func errorResponse(id string, err error, code string) Response {
+	if re, ok := err.(*requestError); ok {
+		code = re.code
+	}
+	return Response{id, "error", err.Error(), code}
 }
 
 func (self *Response) writeJSON(w io.Writer) error {
@@ -29,133 +111,451 @@ func (self *Response) writeJSON(w io.Writer) error {
 }
 
 type server struct {
-	engine  lightning.Engine
+	engine  engine
 	seq     *sequencer
 	samples *samples
+	hub     *hub
+	// project saves the pattern, it is nil if there is no project file
+	project *project
+	// stopAutosave stops the autosave goroutine
+	stopAutosave chan bool
+	// stopWatch stops rescanning the sample directory
+	stopWatch chan bool
+	http      *http.Server
+	// done is closed once when the server shuts down, which
+	// closes the websocket connections
+	done    chan bool
+	closing sync.Once
+	conns   sync.WaitGroup
 }
 
 func (self *server) connect(ch1 string, ch2 string) error {
 	return self.engine.Connect(ch1, ch2)
 }
 
+// listen serves http requests at addr until the server
+// is shut down
 func (self *server) listen(addr string) error {
-	return http.ListenAndServe(addr, nil)
+	ln, el := net.Listen("tcp", addr)
+	if el != nil {
+		return el
+	}
+	return self.serve(ln)
+}
+
+// serve accepts connections on ln until the server is shut down
+func (self *server) serve(ln net.Listener) error {
+	err := self.http.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
 }
 
 func (self *server) readSamples(dir string) error {
 	return self.samples.readSamples(dir)
 }
 
-// samplePlay exposes a websocket endpoint for playing a sample
-func (self *server) samplePlay() websocket.Handler {
-	return func(conn *websocket.Conn) {
-		for {
-			var res Response
-			note, re := lightning.ReadNote(conn)
-			if re != nil {
-				panic(re)
+// openProject loads the pattern from a project file and
+// saves it every autosave interval if it has changed.
+// Autosave is disabled if the interval is 0.
+func (self *server) openProject(path string, autosave time.Duration) error {
+	proj := newProject(path, self.seq)
+	err := proj.load()
+	if err != nil {
+		return err
+	}
+	self.project = proj
+	if autosave > 0 {
+		self.stopAutosave = make(chan bool)
+		go proj.autosave(autosave, self.stopAutosave)
+	}
+	return nil
+}
+
+// openJournal replays the session log at path on top of the
+// project and then logs every change to it. The log is compacted
+// whenever the project is saved, and every compact interval if
+// autosave is disabled.
+func (self *server) openJournal(path string, compact time.Duration) error {
+	if self.project == nil {
+		return errors.New("a session log requires a project file")
+	}
+	last := self.project.logged
+	_, err := readSessionLog(path, last, func(seq uint64, rec *logRecord, events []Event) error {
+		last = seq
+		return self.replay(rec, events)
+	})
+	if err != nil {
+		return err
+	}
+	journal, err := openSessionLog(path)
+	if err != nil {
+		return err
+	}
+	self.hub.seq = last
+	self.hub.journal = journal
+	self.project.hub = self.hub
+	if self.stopAutosave == nil && compact > 0 {
+		self.stopAutosave = make(chan bool)
+		go self.project.autosave(compact, self.stopAutosave)
+	}
+	return nil
+}
+
+// replay applies a record from the session log
+func (self *server) replay(rec *logRecord, events []Event) error {
+	switch rec.Type {
+	case recordCommand:
+		if rec.Command == nil {
+			return errors.New("command record has no command")
+		}
+		_, err := self.apply(rec.Command)
+		return err
+	case recordTempo:
+		self.seq.SetTempo(rec.Tempo)
+		return nil
+	case recordEvents:
+		return self.seq.SetEvents(rec.Pattern, events)
+	case recordChanges:
+		return self.seq.SetNotes(rec.Changes)
+	case recordImport:
+		return self.seq.Batch(func() error {
+			for _, ev := range events {
+				err := self.seq.AddTo(rec.Pattern, ev.Pos, ev.Note)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return fmt.Errorf("unrecognized record type %s", rec.Type)
+}
+
+// save saves the pattern to the project file
+func (self *server) save() error {
+	if self.project == nil {
+		return &requestError{codeInvalid, "no project file"}
+	}
+	return self.project.save()
+}
+
+// pattern returns an http handler that gets a pattern (GET)
+// or replaces its notes (PUT) as a JSON array of Events.
+// The name query parameter selects the pattern, the playing
+// pattern is used if it is missing.
+// Replacing the pattern saves it to the project file, if there is one.
+func (self *server) pattern() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		name := r.URL.Query().Get("name")
+		status := http.StatusBadRequest
+		switch r.Method {
+		case "GET":
+			var events []Event
+			events, err = self.seq.Events(name)
+			if err != nil {
+				status = http.StatusNotFound
+				break
 			}
-			ep := self.engine.PlayNote(note)
-			if ep != nil {
-				panic(ep)
+			err = respondJSON(w, http.StatusOK, events)
+			status = http.StatusInternalServerError
+		case "PUT":
+			events := make([]Event, 0)
+			err = json.NewDecoder(r.Body).Decode(&events)
+			if err != nil {
+				break
 			}
-			res = Response{"ok", "played " + note.Sample}
-			ew := res.writeJSON(conn)
-			if ew != nil {
-				panic(ew)
+			err = self.hub.publish(func() (*Update, error) {
+				name := self.patternName(name)
+				err := self.seq.SetEvents(name, events)
+				if err != nil {
+					return nil, err
+				}
+				rec := &logRecord{Type: recordEvents, Pattern: name}
+				return &Update{Type: updatePattern, Pattern: name, record: rec, events: events}, nil
+			})
+			if err != nil || self.project == nil {
+				break
 			}
+			err = self.project.save()
+			status = http.StatusInternalServerError
+		default:
+			err = errors.New("method not allowed")
+			status = http.StatusMethodNotAllowed
+		}
+		if err != nil {
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
 		}
 	}
 }
 
 // readMessages reads messages for the websocket endpoint
 // and sends them on a channel. errors are sent on the provided error
-// channel. if an error occurs, the method returns
-func (self *server) readMessages(conn *websocket.Conn, c chan interface{}, e chan error) {
-	var msg interface{}
-	dec := json.NewDecoder(conn)
-	for err := dec.Decode(&msg); true; err = dec.Decode(&msg) {
+// channel. if an error occurs, the method returns.
+// Each websocket message is read whole, so a message that is not
+// valid JSON does not stop the next one from being read.
+// The method also returns once stop is closed, when the endpoint
+// no longer receives from the channels.
+func (self *server) readMessages(conn *websocket.Conn, c chan json.RawMessage, e chan error, stop chan bool) {
+	for {
+		var msg []byte
+		err := websocket.Message.Receive(conn, &msg)
 		if err != nil {
-			e <-err
-			break
+			select {
+			case e <- err:
+			case <-stop:
+			}
+			return
 		}
-		c <-msg
+		select {
+		case c <- json.RawMessage(msg):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// closeOnShutdown returns a websocket handler that runs handler
+// and closes its connection when the server shuts down. The
+// server waits for handler to return before it stops.
+func (self *server) closeOnShutdown(handler websocket.Handler) websocket.Handler {
+	return func(conn *websocket.Conn) {
+		self.conns.Add(1)
+		defer self.conns.Done()
+		stop := make(chan bool)
+		defer close(stop)
+		go func() {
+			select {
+			case <-self.done:
+				// send a close frame so the client knows
+				// the server is going away, which also
+				// ends handler's reads
+				conn.Close()
+			case <-stop:
+			}
+		}()
+		handler(conn)
+	}
+}
+
+// handleMessage handles a single message sent to the /sequencer
+// endpoint. Messages are either "start" or "stop", a tempo in bpm,
+// or a Command object which is answered with a Response.
+// Messages that can not be handled are answered with an error
+// Response, the error returned is an error writing to conn.
+func (self *server) handleMessage(conn *websocket.Conn, msg json.RawMessage) error {
+	var s string
+	if json.Unmarshal(msg, &s) == nil {
+		// start or stop
+		err := self.hub.publish(func() (*Update, error) {
+			var err error
+			if s == "start" {
+				err = self.seq.Start()
+			} else if s == "stop" {
+				err = self.seq.Stop()
+			} else {
+				err = &requestError{codeUnknown, fmt.Sprintf("unrecognized sequencer command %s", s)}
+			}
+			if err != nil {
+				return nil, err
+			}
+			return &Update{Type: s}, nil
+		})
+		if err != nil {
+			res := errorResponse("", err, codeInternal)
+			return res.writeJSON(conn)
+		}
+		return nil
+	}
+	var f float64
+	if json.Unmarshal(msg, &f) == nil {
+		// tempo
+		if f <= 0 {
+			res := Response{"", "error", fmt.Sprintf("tempo (%g) must be positive", f), codeInvalid}
+			return res.writeJSON(conn)
+		}
+		return self.hub.publish(func() (*Update, error) {
+			self.seq.SetTempo(float32(f))
+			rec := &logRecord{Type: recordTempo, Tempo: float32(f)}
+			return &Update{Type: updateTempo, Tempo: float32(f), record: rec}, nil
+		})
+	}
+	cmd := new(Command)
+	err := json.Unmarshal(msg, cmd)
+	if err != nil {
+		// answer with the id of the command, if it has one
+		var probe struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(msg, &probe)
+		res := errorResponse(probe.ID, err, codeMalformed)
+		return res.writeJSON(conn)
 	}
+	res := self.execute(cmd)
+	return res.writeJSON(conn)
 }
 
 // sequencerEndpoint creates a websocket handler for the /sequencer endpoint
 func (self *server) sequencerEndpoint(conn *websocket.Conn) {
 	var err error
-	mc := make(chan interface{})
+	self.conns.Add(1)
+	defer self.conns.Done()
+	mc := make(chan json.RawMessage)
 	ec := make(chan error)
-	go self.readMessages(conn, mc, ec)
+	stop := make(chan bool)
+	defer close(stop)
+	uc := self.hub.subscribe()
+	defer self.hub.unsubscribe(uc)
+	pc := self.seq.Subscribe()
+	defer self.seq.Unsubscribe(pc)
+	go self.readMessages(conn, mc, ec, stop)
 	for {
 		select {
-		case err := <-ec:
-			if err == io.EOF {
-				// the client closed the connection
-				goto CloseConnection
-			}
-			if err != nil {
-				panic(err)
+		case err = <-ec:
+			if err != io.EOF {
+				log.Printf("could not read from %s: %s\n", conn.Request().RemoteAddr, err)
 			}
+			// the client closed the connection
+			goto CloseConnection
 		case msg := <-mc:
-			if s, isString := msg.(string); isString {
-				// start or stop
-				if s == "start" {
-					err = self.seq.Start()
-					if err != nil {
-						panic(err)
-					}
-				} else if s == "stop" {
-					err = self.seq.Stop()
-					if err != nil {
-						panic(err)
-					}
-				} else {
-					panic(fmt.Errorf("unrecognized sequencer command %s", s))
-				}
-			} else if f, isFloat := msg.(float64); isFloat {
-				// tempo
-				self.seq.SetTempo(float32(f))
-			}
-		case pos := <-self.seq.PosChan:
+			err = self.handleMessage(conn, msg)
+		case up := <-uc:
+			err = up.WriteJSON(conn)
+		case pos := <-pc:
 			_, err = conn.Write([]byte(strconv.FormatUint(pos, 10)))
-			if err == io.EOF {
-				goto CloseConnection
-			}
-			if err != nil {
-				panic(err)
+		case <-self.done:
+			// send a close frame so the client knows
+			// the server is going away
+			conn.Close()
+			goto CloseConnection
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("could not write to %s: %s\n", conn.Request().RemoteAddr, err)
 			}
+			goto CloseConnection
 		}
 	}
 CloseConnection:
 }
 
-// close closes the audio engine
+// patterns returns an http handler that gets all the
+// patterns and the song
+func (self *server) patterns() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := respondJSON(w, http.StatusOK, self.seq.Bank())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
+
+// position returns an http handler that gets the bar, beat
+// and step of the last position the sequencer played
+func (self *server) position() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := respondJSON(w, http.StatusOK, self.seq.Position())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
+
+// shutdown stops the sequencer, closes the websocket connections
+// with a close frame, stops the http server, saves the project if
+// it has changed and closes the session log and the audio engine.
+// Connections and requests that have not finished after timeout
+// are cut off.
+func (self *server) shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := self.seq.Stop()
+	self.closing.Do(func() { close(self.done) })
+	drained := make(chan bool)
+	go func() {
+		self.conns.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		if err == nil {
+			err = errors.New("timed out closing websocket connections")
+		}
+	}
+	es := self.http.Shutdown(ctx)
+	if err == nil {
+		err = es
+	}
+	if self.project != nil && self.project.dirty() {
+		es = self.project.save()
+		if err == nil {
+			err = es
+		}
+	}
+	self.close()
+	return err
+}
+
+// close stops autosaving and closes the session log and the
+// audio engine, without saving the project
 func (self *server) close() {
+	if self.stopAutosave != nil {
+		close(self.stopAutosave)
+	}
+	if self.stopWatch != nil {
+		close(self.stopWatch)
+	}
+	if self.hub.journal != nil {
+		self.hub.journal.close()
+	}
 	self.engine.Close()
 }
 
 // newServer creates a websocket/rest server that manages the bulk
-// of lightningd functionality
-func newServer(www string) (*server, error) {
+// of lightningd functionality, playing notes with engine at the
+// tempo of clock
+func newServer(www string, engine engine, clock clock) (*server, error) {
 	srv := new(server)
-	srv.engine = lightning.NewEngine()
+	srv.engine = engine
 	// initialize tempo to 120 bpm (a typical
 	// starting point for sequencers)
-	srv.seq = newSequencer(srv.engine, patternLength, 120)
+	srv.seq = newSequencer(srv.engine, clock, patternLength, 120)
+	// updates to the sequencer are broadcast to all clients
+	srv.hub = newHub()
 	// initialize samples
 	srv.samples = newSamples(srv.engine)
-	// setup handlers under default ServeMux
+	srv.seq.lookup = srv.samples.lookup
+	mux := http.NewServeMux()
+	srv.http = &http.Server{Handler: mux}
+	srv.done = make(chan bool)
+	// setup handlers under the server's own ServeMux, so a
+	// process can create more than one server
 	fileServer := http.FileServer(http.Dir(www))
 	// static file server
-	http.Handle("/", fileServer)
+	mux.Handle("/", fileServer)
 	// http endpoints
-	http.HandleFunc("/samples", srv.samples.list())
+	mux.HandleFunc("/samples", srv.sampleFiles())
+	mux.HandleFunc("/samples/", srv.sample())
+	mux.HandleFunc("/samples/rescan", srv.rescan())
+	mux.HandleFunc("/samples/tags", srv.samples.tagSample())
+	mux.HandleFunc("/samples/regions", srv.regions())
+	mux.HandleFunc("/samples/slice", srv.slice())
+	mux.HandleFunc("/pattern", srv.pattern())
+	mux.HandleFunc("/pattern/events", srv.events())
+	mux.HandleFunc("/pattern/midi", srv.midi())
+	mux.HandleFunc("/patterns", srv.patterns())
+	mux.HandleFunc("/song/midi", srv.songMidi())
+	mux.HandleFunc("/render", srv.render())
+	mux.HandleFunc("/position", srv.position())
 	// websocket endpoints
-	http.Handle("/sample/play", srv.samples.play())
-	http.Handle("/sequencer", websocket.Handler(srv.sequencerEndpoint))
+	mux.Handle("/sample/play", srv.closeOnShutdown(srv.samples.play()))
+	mux.Handle("/sequencer", websocket.Handler(srv.sequencerEndpoint))
 	// http.Handle("/note/remove", srv.noteRemove())
 	// http.Handle("/pattern/play", srv.patternPlay())
 	// http.Handle("/pattern/stop", srv.patternStop())
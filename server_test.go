@@ -1,47 +1,286 @@
 package main
 
-import "fmt"
+import "encoding/json"
+import "github.com/bmizerany/assert"
+import "golang.org/x/net/websocket"
+import "io"
+import "io/ioutil"
+import "math"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "os"
+import "path/filepath"
+import "strings"
 import "testing"
 import "time"
 
+// newTestServer returns a server that plays a 16 step pattern
+// at 120 bpm on a null engine and a virtual clock, without a
+// sample directory
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	engine := newNullEngine()
+	srv := &server{engine: engine, seq: newSequencer(engine, newVirtualClock(), 16, 120), hub: newHub()}
+	srv.samples = newSamples(engine)
+	srv.seq.lookup = srv.samples.lookup
+	return srv
+}
+
+// waitFor reads the updates a client receives until one has type
+func waitFor(t *testing.T, cl *client, typ string) Update {
+	t.Helper()
+	for {
+		select {
+		case up := <-cl.Updates:
+			if up.Type == typ {
+				return up
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("did not receive a %s update", typ)
+		}
+	}
+}
+
 func TestServer(t *testing.T) {
-	port := 25870
-	addr := fmt.Sprintf("localhost:%d", port)
-	server, err := newServer(".")
+	clock := newVirtualClock()
+	server, err := newServer(".", newNullEngine(), clock)
 	if err != nil {
 		t.Fatal(err)
 	}
-	go server.listen(addr)
-	time.Sleep(50 * time.Millisecond)
+	ln, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
 		t.Fatal(err)
 	}
+	go server.serve(ln)
+	port := ln.Addr().(*net.TCPAddr).Port
 	origin := "http://localhost/"
 	c, err := newClient(origin, port)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = c.play()
+	other, err := newClient(origin, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// add a note and wait for the sequencer to confirm it
+	note := NewNote("kick", 60, 100)
+	err = c.send(&Command{ID: "n1", Command: "add", Event: &Event{0, note}})
 	if err != nil {
 		t.Fatal(err)
 	}
-	positions := make([]bool, 16)
-	fmt.Println("getting pattern positions")
-	for pos := range c.PatternPosition {
-		if pos == uint64(16) {
-			break
+	res := <-c.Responses
+	if res.ID != "n1" || res.Status != "ok" {
+		t.Fatalf("unexpected response %v", res)
+	}
+	// the edit is also broadcast to every client
+	for _, cl := range []*client{c, other} {
+		up := waitFor(t, cl, "add")
+		if up.Event.Note.Sample != "kick" {
+			t.Fatalf("unexpected update %v", up)
 		}
-		fmt.Printf("got %v\n", pos)
-		positions[pos] = true
 	}
-	for i, received := range positions {
-		if received != true {
-			t.Fatalf("did not receive position %d", i)
+	err = c.play()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cl := range []*client{c, other} {
+		waitFor(t, cl, "start")
+	}
+	// every client receives every position the clock steps to
+	for pos := uint64(0); pos < 16; pos++ {
+		err = clock.Advance(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cl := range []*client{c, other} {
+			if received := <-cl.PatternPosition; received != pos {
+				t.Fatalf("received position %d instead of %d", received, pos)
+			}
 		}
 	}
 	err = c.stop()
 	if err != nil {
 		t.Fatal(err)
 	}
-	server.close()
+	waitFor(t, c, "stop")
+	err = server.shutdown(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerPattern(t *testing.T) {
+	srv := newTestServer(t)
+	handler := srv.pattern()
+	updates := srv.hub.subscribe()
+
+	// replace the pattern
+	body := `[{"pos":1,"note":{"sample":"kick","number":60,"velocity":100}}]`
+	req, _ := http.NewRequest("PUT", "/pattern", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, (<-updates).Type, "pattern")
+
+	// get it back
+	req, _ = http.NewRequest("GET", "/pattern", nil)
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Body.String(), body+"\n")
+
+	// positions outside the pattern are rejected
+	body = `[{"pos":16,"note":{"sample":"kick","number":60,"velocity":100}}]`
+	req, _ = http.NewRequest("PUT", "/pattern", strings.NewReader(body))
+	w = httptest.NewRecorder()
+	handler(w, req)
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+	events, _ := srv.seq.Events("")
+	assert.Equal(t, len(events), 1)
+}
+
+func TestServerShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newTestServer(t)
+	srv.http, srv.done = new(http.Server), make(chan bool)
+	err = srv.openProject(filepath.Join(dir, "song.json"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(websocket.Handler(srv.sequencerEndpoint))
+	defer ts.Close()
+	ps := httptest.NewServer(srv.closeOnShutdown(srv.samples.play()))
+	defer ps.Close()
+	conns := []*websocket.Conn{dial(t, ts), dial(t, ts), dial(t, ps)}
+	for _, conn := range conns {
+		defer conn.Close()
+	}
+	srv.execute(&Command{Command: "add", Event: &Event{0, NewNote("kick", 60, 100)}})
+	srv.seq.Start()
+	// a client that is being answered as the server shuts down
+	websocket.Message.Send(conns[2], `{"sample":"kick"}`)
+
+	err = srv.shutdown(time.Second)
+	assert.Equal(t, err, nil)
+	// every connection is closed, the ones to the sequencer
+	// after the update is sent
+	for _, conn := range conns {
+		var msg []byte
+		for err = nil; err == nil; {
+			err = websocket.Message.Receive(conn, &msg)
+		}
+		assert.Equal(t, err, io.EOF)
+	}
+	// shutting down again does nothing
+	err = srv.shutdown(time.Second)
+	assert.Equal(t, err, nil)
+	// unsaved changes are saved
+	assert.Equal(t, srv.project.dirty(), false)
+	bank, err := readBank(filepath.Join(dir, "song.json"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(bank.Patterns[0].Notes[0]), 1)
+	assert.NotEqual(t, srv.engine.PlayNote(&NewNote("kick", 60, 100).Note), nil)
+}
+
+func TestServerReadMessages(t *testing.T) {
+	srv := newTestServer(t)
+	returned := make(chan bool)
+	ts := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		stop := make(chan bool)
+		close(stop)
+		// nothing receives the message or the error
+		srv.readMessages(conn, make(chan json.RawMessage), make(chan error), stop)
+		close(returned)
+	}))
+	defer ts.Close()
+	conn := dial(t, ts)
+	websocket.Message.Send(conn, `"start"`)
+	conn.Close()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("readMessages did not return after it was stopped")
+	}
+}
+
+func TestRespondJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	err := respondJSON(w, http.StatusCreated, map[string]int{"a": 1})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, w.Code, http.StatusCreated)
+	assert.Equal(t, w.Body.String(), `{"a":1}`+"\n")
+
+	// nothing is sent if the value can not be encoded, so
+	// the error can still be responded to
+	w = httptest.NewRecorder()
+	err = respondJSON(w, http.StatusCreated, math.NaN())
+	assert.NotEqual(t, err, nil)
+	w.WriteHeader(http.StatusInternalServerError)
+	assert.Equal(t, w.Code, http.StatusInternalServerError)
+	assert.Equal(t, w.Body.Len(), 0)
+}
+
+// dial opens a websocket connection to a test server
+func dial(t *testing.T, ts *httptest.Server) *websocket.Conn {
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), "", "http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// roundTrip sends msg to a websocket endpoint and returns
+// the Response it is answered with, skipping updates
+func roundTrip(t *testing.T, conn *websocket.Conn, msg string) Response {
+	err := websocket.Message.Send(conn, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var res struct {
+			Response
+			Seq *uint64 `json:"seq"`
+		}
+		err = websocket.JSON.Receive(conn, &res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Seq == nil {
+			return res.Response
+		}
+	}
+}
+
+func TestServerMalformed(t *testing.T) {
+	srv := newTestServer(t)
+	ts := httptest.NewServer(websocket.Handler(srv.sequencerEndpoint))
+	defer ts.Close()
+	conn := dial(t, ts)
+	defer conn.Close()
+
+	res := roundTrip(t, conn, `{"id":"1","command":"add","event":"kick"}`)
+	assert.Equal(t, res.ID, "1")
+	assert.Equal(t, res.Status, "error")
+	assert.Equal(t, res.Code, codeMalformed)
+	res = roundTrip(t, conn, `{"id":"2",`)
+	assert.Equal(t, res.Code, codeMalformed)
+	assert.Equal(t, res.Message, "unexpected end of JSON input")
+	res = roundTrip(t, conn, `"rewind"`)
+	assert.Equal(t, res, Response{"", "error", "unrecognized sequencer command rewind", codeUnknown})
+	res = roundTrip(t, conn, `-10`)
+	assert.Equal(t, res, Response{"", "error", "tempo (-10) must be positive", codeInvalid})
+	res = roundTrip(t, conn, `{"id":"3","command":"transpose"}`)
+	assert.Equal(t, res, Response{"3", "error", "unrecognized sequencer command transpose", codeUnknown})
+	res = roundTrip(t, conn, `{"id":"4","command":"save"}`)
+	assert.Equal(t, res, Response{"4", "error", "no project file", codeInvalid})
+
+	// the connection is still usable
+	res = roundTrip(t, conn, `{"id":"5","command":"add","event":{"pos":0,"note":{"sample":"kick"}}}`)
+	assert.Equal(t, res, Response{"5", "ok", "add", ""})
+	assert.Equal(t, len(srv.seq.NotesAt("", 0)), 1)
 }
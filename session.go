@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// types of records in the session log
+const (
+	// a Command that was applied
+	recordCommand = "command"
+	// a tempo change
+	recordTempo = "tempo"
+	// the notes of a pattern were replaced by the
+	// Events on the lines following the record
+	recordEvents = "events"
+	// notes were restored by undo or redo
+	recordChanges = "changes"
+	// the notes of the Events on the lines following
+	// the record were added to a pattern
+	recordImport = "import"
+)
+
+// logRecord is a line in the session log. Seq is the Seq of
+// the Update that was published when the change was applied.
+type logRecord struct {
+	Seq     uint64   `json:"seq"`
+	Type    string   `json:"type"`
+	Command *Command `json:"command,omitempty"`
+	Tempo   float32  `json:"tempo,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+	Events  int      `json:"events,omitempty"`
+	Changes []Change `json:"changes,omitempty"`
+}
+
+// sessionLog is an append-only log of the changes made to
+// the sequencer since the project file was last saved, written
+// as JSON lines. The changes are replayed on top of the project
+// file when lightningd starts, so nothing is lost if it dies
+// before the project is saved.
+// The log is only written to while the hub is held, since it
+// has to record changes in the order they were applied.
+type sessionLog struct {
+	path string
+	file *os.File
+}
+
+// append writes a record to the log, followed by events
+// if it is an events record
+func (self *sessionLog) append(seq uint64, rec *logRecord, events []Event) error {
+	rec.Seq = seq
+	rec.Events = len(events)
+	buf := new(bytes.Buffer)
+	ew := json.NewEncoder(buf).Encode(rec)
+	for i := 0; ew == nil && i < len(events); i++ {
+		ew = events[i].WriteJSON(buf)
+	}
+	if ew != nil {
+		return ew
+	}
+	// a single write, so a crash can only leave the
+	// last record half-written
+	_, ew = self.file.Write(buf.Bytes())
+	return ew
+}
+
+// compact removes the records that are included in a project
+// file saved after the update with Seq seq. The log is rewritten
+// to a temporary file which is then renamed.
+func (self *sessionLog) compact(seq uint64) error {
+	dir, base := filepath.Split(self.path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, et := ioutil.TempFile(dir, base+".tmp")
+	if et != nil {
+		return et
+	}
+	kept := &sessionLog{tmp.Name(), tmp}
+	_, er := readSessionLog(self.path, seq, kept.append)
+	if er == nil {
+		er = tmp.Sync()
+	}
+	ec := tmp.Close()
+	if er == nil {
+		er = ec
+	}
+	if er == nil {
+		er = os.Rename(tmp.Name(), self.path)
+	}
+	if er != nil {
+		os.Remove(tmp.Name())
+		return er
+	}
+	file, eo := os.OpenFile(self.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if eo != nil {
+		return eo
+	}
+	self.file.Close()
+	self.file = file
+	return nil
+}
+
+// close closes the log file
+func (self *sessionLog) close() error {
+	return self.file.Close()
+}
+
+// openSessionLog opens the session log at path for appending,
+// creating it if it does not exist. A record that was cut off by
+// a crash is removed first, so the records that are appended can
+// be read.
+func openSessionLog(path string) (*sessionLog, error) {
+	end, er := readSessionLog(path, math.MaxUint64, nil)
+	if er != nil {
+		return nil, er
+	}
+	file, eo := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if eo != nil {
+		return nil, eo
+	}
+	// keep the newline after the last complete record
+	next := make([]byte, 1)
+	if _, er = file.ReadAt(next, end); er == nil && next[0] == '\n' {
+		end += 1
+	}
+	et := file.Truncate(end)
+	if et != nil {
+		file.Close()
+		return nil, et
+	}
+	return &sessionLog{path, file}, nil
+}
+
+// readSessionLog calls fn with every record in the log at path
+// that has a Seq greater than after, along with its events, and
+// returns the offset the last complete record ends at. A log that
+// does not exist has no records. A record that was cut off by a
+// crash ends the log.
+func readSessionLog(path string, after uint64, fn func(seq uint64, rec *logRecord, events []Event) error) (int64, error) {
+	file, eo := os.Open(path)
+	if os.IsNotExist(eo) {
+		return 0, nil
+	}
+	if eo != nil {
+		return 0, eo
+	}
+	defer file.Close()
+	dec := json.NewDecoder(file)
+	end := int64(0)
+	for {
+		rec := new(logRecord)
+		ed := dec.Decode(rec)
+		if ed == io.EOF || ed == io.ErrUnexpectedEOF {
+			return end, nil
+		}
+		if ed != nil {
+			return end, ed
+		}
+		events := make([]Event, rec.Events)
+		for i := range events {
+			ed = dec.Decode(&events[i])
+			if ed == io.EOF || ed == io.ErrUnexpectedEOF {
+				return end, nil
+			}
+			if ed != nil {
+				return end, ed
+			}
+		}
+		end = dec.InputOffset()
+		if rec.Seq <= after {
+			continue
+		}
+		ef := fn(rec.Seq, rec, events)
+		if ef != nil {
+			return end, fmt.Errorf("session log record %d: %s", rec.Seq, ef)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readRecords returns the Seqs of the records in a session log
+func readRecords(t *testing.T, path string) []uint64 {
+	seqs := make([]uint64, 0)
+	_, err := readSessionLog(path, 0, func(seq uint64, rec *logRecord, events []Event) error {
+		seqs = append(seqs, seq)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return seqs
+}
+
+func TestSessionLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.log")
+
+	journal, err := openSessionLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.close()
+	events := []Event{{0, NewNote("kick", 60, 100)}, {4, NewNote("snare", 60, 100)}}
+	journal.append(1, &logRecord{Type: recordTempo, Tempo: 140}, nil)
+	journal.append(2, &logRecord{Type: recordEvents, Pattern: "main"}, events)
+	journal.append(3, &logRecord{Type: recordCommand, Command: &Command{Command: "clear", Event: &Event{Pos: 4}}}, nil)
+
+	var read []Event
+	_, err = readSessionLog(path, 1, func(seq uint64, rec *logRecord, events []Event) error {
+		if rec.Type == recordEvents {
+			read = events
+		}
+		return nil
+	})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, read, events)
+
+	// a record cut off by a crash ends the log
+	journal.file.Write([]byte(`{"seq": 4, "type": "tem`))
+	assert.Equal(t, readRecords(t, path), []uint64{1, 2, 3})
+
+	err = journal.compact(2)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, readRecords(t, path), []uint64{3})
+	journal.append(4, &logRecord{Type: recordTempo, Tempo: 120}, nil)
+	assert.Equal(t, readRecords(t, path), []uint64{3, 4})
+}
+
+func TestServerRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, journal := filepath.Join(dir, "song.json"), filepath.Join(dir, "song.log")
+
+	open := func() *server {
+		srv := newTestServer(t)
+		err := srv.openProject(path, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = srv.openJournal(journal, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return srv
+	}
+
+	srv := open()
+	kick := NewNote("kick", 60, 100)
+	srv.execute(&Command{Command: "add", Event: &Event{0, kick}})
+	srv.execute(&Command{Command: "pattern.create", Pattern: "verse", Length: 8})
+	err = srv.save()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, readRecords(t, journal), []uint64{})
+	srv.execute(&Command{Command: "add", Event: &Event{4, kick}})
+	srv.execute(&Command{Command: "add", Pattern: "verse", Event: &Event{2, kick}})
+	srv.execute(&Command{Command: "undo"})
+	srv.handleMessage(nil, []byte("140"))
+	srv.importEvents("verse", strings.NewReader(`[{"pos":7,"note":{"sample":"kick"}}]`))
+	srv.close()
+
+	// the changes after the save are replayed on top of the project
+	srv = open()
+	defer srv.close()
+	assert.Equal(t, srv.seq.Patterns(), []string{"main", "verse"})
+	assert.Equal(t, len(srv.seq.NotesAt("", 0)), 1)
+	assert.Equal(t, len(srv.seq.NotesAt("", 4)), 1)
+	assert.Equal(t, len(srv.seq.NotesAt("verse", 2)), 0)
+	assert.Equal(t, len(srv.seq.NotesAt("verse", 7)), 1)
+	assert.Equal(t, srv.seq.Bank().Tempo, float32(140))
+	assert.Equal(t, srv.hub.seq, uint64(7))
+}
+
+func TestSessionLogCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.log")
+
+	journal, err := openSessionLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.append(1, &logRecord{Type: recordTempo, Tempo: 140}, nil)
+	events := []Event{{0, NewNote("kick", 60, 100)}, {4, NewNote("snare", 60, 100)}}
+	journal.append(2, &logRecord{Type: recordEvents, Pattern: "main"}, events)
+	// crash while the events of a record are written
+	journal.file.Write([]byte(`{"seq":3,"type":"events","pattern":"main","events":2}` + "\n" + `{"pos":0,"no`))
+	journal.close()
+
+	// every restart appends to the records that were read
+	for seq := uint64(3); seq <= 4; seq++ {
+		journal, err = openSessionLog(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		journal.append(seq, &logRecord{Type: recordTempo, Tempo: 120}, nil)
+		journal.close()
+		seqs := readRecords(t, path)
+		assert.Equal(t, seqs[len(seqs)-1], seq)
+	}
+	assert.Equal(t, readRecords(t, path), []uint64{1, 2, 3, 4})
+	bs, _ := ioutil.ReadFile(path)
+	assert.Equal(t, strings.Count(string(bs), "\n"), 6)
+}
+
+func TestServerRecoverPlaying(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, journal := filepath.Join(dir, "song.json"), filepath.Join(dir, "song.log")
+
+	open := func() *server {
+		srv := newTestServer(t)
+		err := srv.openProject(path, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = srv.openJournal(journal, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return srv
+	}
+
+	srv := open()
+	srv.execute(&Command{Command: "pattern.create", Pattern: "b", Length: 16})
+	srv.execute(&Command{Command: "pattern.switch", Pattern: "b"})
+	steps(t, srv.seq, 16)
+	assert.Equal(t, srv.seq.Playing(), "b")
+	updates := srv.hub.subscribe()
+	res := srv.execute(&Command{Command: "add", Event: &Event{2, NewNote("kick", 60, 100)}})
+	assert.Equal(t, res.Status, "ok")
+	// the update names the pattern that was edited
+	up := <-updates
+	assert.Equal(t, up.Pattern, "b")
+	srv.hub.unsubscribe(updates)
+	srv.close()
+
+	// the note is replayed into the pattern that was playing,
+	// not the one that plays when the log is replayed
+	srv = open()
+	defer srv.close()
+	assert.Equal(t, srv.seq.Playing(), "main")
+	assert.Equal(t, len(srv.seq.NotesAt("b", 2)), 1)
+	assert.Equal(t, len(srv.seq.NotesAt("main", 2)), 0)
+}
+
+func TestServerRecoverGroove(t *testing.T) {
+	restoreGrooves(t)
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, journal := filepath.Join(dir, "song.json"), filepath.Join(dir, "song.log")
+
+	srv := newTestServer(t)
+	err = srv.openProject(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.openJournal(journal, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.execute(&Command{Command: "groove.define", Groove: &Groove{Name: "polka", Offsets: []float64{0, 0.1}}})
+	err = srv.save()
+	assert.Equal(t, err, nil)
+	res := srv.execute(&Command{Command: "groove", Groove: &Groove{Name: "polka"}})
+	assert.Equal(t, res.Status, "ok")
+	srv.close()
+
+	// a restarted server does not have the template
+	grooves.Lock()
+	delete(grooves.templates, "polka")
+	grooves.Unlock()
+	srv = newTestServer(t)
+	defer srv.close()
+	err = srv.openProject(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = srv.openJournal(journal, 0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, srv.seq.Bank().Patterns[0].Groove, &Groove{Name: "polka", Offsets: []float64{0, 0.1}})
+}
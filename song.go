@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SongEntry is one entry in a song arrangement.
+// The pattern is played Repeat times before the sequencer
+// moves on to the next entry.
+type SongEntry struct {
+	Pattern string `json:"pattern"`
+	Repeat  int    `json:"repeat"`
+}
+
+// Bank is a snapshot of the sequencer's patterns, song and tempo.
+// Seq is the Seq of the last update included in a project file,
+// changes in the session log after it are replayed on top of it.
+type Bank struct {
+	Patterns []*Pattern  `json:"patterns"`
+	Song     []SongEntry `json:"song,omitempty"`
+	Playing  string      `json:"playing"`
+	Tempo    float32     `json:"tempo,omitempty"`
+	Seq      uint64      `json:"seq,omitempty"`
+}
+
+// Bank returns a copy of the sequencer's patterns and song.
+func (self *sequencer) Bank() *Bank {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	bank := &Bank{
+		Patterns: make([]*Pattern, len(self.patterns)),
+		Song:     append([]SongEntry(nil), self.song...),
+		Playing:  self.pattern.Name,
+		Tempo:    self.tempo,
+	}
+	for i, pat := range self.patterns {
+		bank.Patterns[i] = pat.Copy(pat.Name)
+	}
+	return bank
+}
+
+// find returns the pattern in the bank with the given name,
+// or nil. An empty name means the playing pattern.
+func (self *Bank) find(name string) *Pattern {
+	if name == "" {
+		name = self.Playing
+	}
+	for _, pat := range self.Patterns {
+		if pat.Name == name {
+			return pat
+		}
+	}
+	return nil
+}
+
+// arrangement returns the patterns in the order the song
+// plays them, with each pattern repeated
+func (self *Bank) arrangement() []*Pattern {
+	patterns := make([]*Pattern, 0)
+	for _, entry := range self.Song {
+		pat := self.find(entry.Pattern)
+		for i := 0; pat != nil && i < entry.Repeat; i++ {
+			patterns = append(patterns, pat)
+		}
+	}
+	return patterns
+}
+
+// SetBank replaces the sequencer's patterns and song, and
+// the tempo if the bank has one.
+func (self *sequencer) SetBank(bank *Bank) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if len(bank.Patterns) == 0 {
+		return errors.New("bank has no patterns")
+	}
+	names := make(map[string]bool)
+	for i, pat := range bank.Patterns {
+		if pat == nil {
+			return fmt.Errorf("pattern %d can not be nil", i)
+		}
+		err := validPattern(pat.Name, pat.Length)
+		if err != nil {
+			return err
+		}
+		if names[pat.Name] {
+			return fmt.Errorf("pattern %s already exists", pat.Name)
+		}
+		if len(pat.Notes) != pat.Length {
+			return fmt.Errorf("pattern %s has %d positions but length %d", pat.Name, len(pat.Notes), pat.Length)
+		}
+		if pat.Meter != nil {
+			err = pat.Meter.validate()
+			if err != nil {
+				return fmt.Errorf("pattern %s: %s", pat.Name, err)
+			}
+		}
+		if pat.Loop != nil {
+			err = pat.Loop.validate(pat.Length)
+			if err != nil {
+				return fmt.Errorf("pattern %s: %s", pat.Name, err)
+			}
+		}
+		if pat.Groove != nil {
+			err = pat.Groove.validate()
+			if err != nil {
+				return fmt.Errorf("pattern %s: %s", pat.Name, err)
+			}
+		}
+		err = pat.validTracks()
+		if err != nil {
+			return fmt.Errorf("pattern %s: %s", pat.Name, err)
+		}
+		names[pat.Name] = true
+	}
+	err := validSong(bank.Song, names)
+	if err != nil {
+		return err
+	}
+	if bank.Tempo < 0 {
+		return fmt.Errorf("tempo (%g) can not be negative", bank.Tempo)
+	}
+	// the playing pattern is replaced, so playback restarts
+	// at the first song entry, or at the pattern named Playing
+	self.patterns = bank.Patterns
+	self.song = bank.Song
+	self.songPos, self.repeats = -1, 0
+	playing := bank.Playing
+	if len(self.song) > 0 {
+		self.songPos = 0
+		playing = self.song[0].Pattern
+	}
+	pat := self.find(playing)
+	if pat == nil {
+		pat = self.patterns[0]
+	}
+	if bank.Tempo > 0 {
+		self.tempo = bank.Tempo
+		self.clock.SetTempo(self.metroTempo())
+	}
+	self.switchTo(pat)
+	self.history = journal{}
+	self.edits += 1
+	return nil
+}
+
+// Patterns returns the names of the patterns in the bank.
+func (self *sequencer) Patterns() []string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	names := make([]string, len(self.patterns))
+	for i, pat := range self.patterns {
+		names[i] = pat.Name
+	}
+	return names
+}
+
+// PatternsUsing returns the names of the patterns
+// that play a sample.
+func (self *sequencer) PatternsUsing(sample string) []string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	names := make([]string, 0)
+	for _, pat := range self.patterns {
+		if pat.uses(sample) {
+			names = append(names, pat.Name)
+		}
+	}
+	return names
+}
+
+// Song returns the song arrangement.
+func (self *sequencer) Song() []SongEntry {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return append([]SongEntry(nil), self.song...)
+}
+
+// Playing returns the name of the playing pattern.
+func (self *sequencer) Playing() string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.pattern.Name
+}
+
+// CreatePattern adds an empty pattern to the end of the bank.
+func (self *sequencer) CreatePattern(name string, length int) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	err := validPattern(name, length)
+	if err != nil {
+		return err
+	}
+	if self.find(name) != nil {
+		return fmt.Errorf("pattern %s already exists", name)
+	}
+	pat := NewPattern(length)
+	pat.Name = name
+	self.patterns = append(self.patterns, pat)
+	self.edits += 1
+	return nil
+}
+
+// DuplicatePattern adds a copy of the pattern src to the end
+// of the bank.
+func (self *sequencer) DuplicatePattern(src, name string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pat := self.find(src)
+	if pat == nil {
+		return fmt.Errorf("pattern %s does not exist", src)
+	}
+	err := validPattern(name, pat.Length)
+	if err != nil {
+		return err
+	}
+	if self.find(name) != nil {
+		return fmt.Errorf("pattern %s already exists", name)
+	}
+	self.patterns = append(self.patterns, pat.Copy(name))
+	self.edits += 1
+	return nil
+}
+
+// DeletePattern removes a pattern from the bank and
+// from the song. The playing pattern can not be deleted.
+func (self *sequencer) DeletePattern(name string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	i := self.index(name)
+	if i < 0 {
+		return fmt.Errorf("pattern %s does not exist", name)
+	}
+	pat := self.patterns[i]
+	if pat == self.pattern {
+		return fmt.Errorf("can not delete the playing pattern %s", name)
+	}
+	self.patterns = append(self.patterns[:i], self.patterns[i+1:]...)
+	self.history.forget(name)
+	if self.next == pat {
+		self.next = nil
+	}
+	song := make([]SongEntry, 0, len(self.song))
+	for j, entry := range self.song {
+		if entry.Pattern != name {
+			song = append(song, entry)
+		} else if j < self.songPos {
+			self.songPos -= 1
+		}
+	}
+	self.setSong(song)
+	self.edits += 1
+	return nil
+}
+
+// MovePattern moves a pattern to a new index in the bank.
+func (self *sequencer) MovePattern(name string, index int) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	i := self.index(name)
+	if i < 0 {
+		return fmt.Errorf("pattern %s does not exist", name)
+	}
+	if index < 0 || index >= len(self.patterns) {
+		return fmt.Errorf("index (%d) out of range", index)
+	}
+	pat := self.patterns[i]
+	self.patterns = append(self.patterns[:i], self.patterns[i+1:]...)
+	self.patterns = append(self.patterns[:index], append([]*Pattern{pat}, self.patterns[index:]...)...)
+	self.edits += 1
+	return nil
+}
+
+// SwitchPattern plays a pattern from the next bar boundary.
+// The sequencer stops following the song.
+func (self *sequencer) SwitchPattern(name string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	pat := self.find(name)
+	if pat == nil {
+		return fmt.Errorf("pattern %s does not exist", name)
+	}
+	self.next = pat
+	self.songPos = -1
+	return nil
+}
+
+// SetSong sets the song arrangement. The sequencer follows the
+// song from its first entry at the next bar boundary. An empty
+// song stops the sequencer from following the song.
+func (self *sequencer) SetSong(song []SongEntry) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	names := make(map[string]bool)
+	for _, pat := range self.patterns {
+		names[pat.Name] = true
+	}
+	err := validSong(song, names)
+	if err != nil {
+		return err
+	}
+	self.song = append([]SongEntry(nil), song...)
+	self.songPos, self.repeats = -1, 0
+	if len(song) > 0 {
+		self.songPos = 0
+		self.next = self.find(song[0].Pattern)
+	}
+	self.edits += 1
+	return nil
+}
+
+// setSong replaces the song after patterns have been
+// removed from it. The caller must hold mu.
+func (self *sequencer) setSong(song []SongEntry) {
+	self.song = song
+	if len(song) == 0 {
+		self.songPos = -1
+	} else if self.songPos >= len(song) {
+		self.songPos = 0
+	}
+}
+
+// index returns the index of the named pattern in the
+// bank, or -1. The caller must hold mu.
+func (self *sequencer) index(name string) int {
+	for i, pat := range self.patterns {
+		if pat.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// validPattern returns an error if a pattern can not
+// be created with name and length
+func validPattern(name string, length int) error {
+	if name == "" {
+		return errors.New("pattern name can not be empty")
+	}
+	return validLength(length)
+}
+
+// validSong returns an error if a song refers to
+// patterns that are not in names
+func validSong(song []SongEntry, names map[string]bool) error {
+	for _, entry := range song {
+		if !names[entry.Pattern] {
+			return fmt.Errorf("pattern %s does not exist", entry.Pattern)
+		}
+		if entry.Repeat <= 0 {
+			return fmt.Errorf("pattern %s must repeat at least once", entry.Pattern)
+		}
+	}
+	return nil
+}
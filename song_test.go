@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+// steps advances the sequencer n positions without a clock
+func steps(t *testing.T, seq *sequencer, n int) {
+	for i := 0; i < n; i++ {
+		err := seq.step()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSequencerBank(t *testing.T) {
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 32, 120)
+	assert.Equal(t, seq.Patterns(), []string{"main"})
+
+	err := seq.CreatePattern("verse", 16)
+	assert.Equal(t, err, nil)
+	err = seq.CreatePattern("verse", 16)
+	assert.Equal(t, err.Error(), "pattern verse already exists")
+	err = seq.CreatePattern("empty", 0)
+	assert.Equal(t, err.Error(), "pattern length (0) must be positive")
+	err = seq.CreatePattern("huge", 1<<40)
+	assert.Equal(t, err.Error(), "pattern length (1099511627776) can not be greater than 65536")
+
+	seq.AddTo("verse", 3, NewNote("kick", 60, 100))
+	err = seq.DuplicatePattern("verse", "chorus")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(seq.NotesAt("chorus", 3)), 1)
+	// editing the copy does not change the original
+	seq.Clear("chorus", 3)
+	assert.Equal(t, len(seq.NotesAt("verse", 3)), 1)
+
+	err = seq.MovePattern("chorus", 0)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, seq.Patterns(), []string{"chorus", "main", "verse"})
+
+	err = seq.DeletePattern("main")
+	assert.Equal(t, err.Error(), "can not delete the playing pattern main")
+	err = seq.DeletePattern("chorus")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, seq.Patterns(), []string{"main", "verse"})
+}
+
+func TestSequencerSwitchPattern(t *testing.T) {
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 64, 120)
+	seq.CreatePattern("fill", 16)
+	steps(t, seq, 5)
+	err := seq.SwitchPattern("fill")
+	assert.Equal(t, err, nil)
+	// the switch waits for the next bar
+	steps(t, seq, 10)
+	assert.Equal(t, seq.Playing(), "main")
+	steps(t, seq, 1)
+	assert.Equal(t, seq.Playing(), "fill")
+	assert.Equal(t, seq.pos, uint64(0))
+}
+
+func TestSequencerSong(t *testing.T) {
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 16, 120)
+	seq.CreatePattern("verse", 16)
+	seq.CreatePattern("chorus", 32)
+	err := seq.SetSong([]SongEntry{{"verse", 2}, {"chorus", 1}})
+	assert.Equal(t, err, nil)
+	steps(t, seq, 16)
+	assert.Equal(t, seq.Playing(), "verse")
+	steps(t, seq, 16)
+	assert.Equal(t, seq.Playing(), "verse")
+	steps(t, seq, 16)
+	assert.Equal(t, seq.Playing(), "chorus")
+	steps(t, seq, 32)
+	// the song loops
+	assert.Equal(t, seq.Playing(), "verse")
+
+	err = seq.SetSong([]SongEntry{{"bridge", 1}})
+	assert.Equal(t, err.Error(), "pattern bridge does not exist")
+	// deleting a pattern removes it from the song
+	seq.DeletePattern("chorus")
+	assert.Equal(t, seq.Song(), []SongEntry{{"verse", 2}})
+}
+
+func TestSequencerSetBank(t *testing.T) {
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 16, 120)
+	seq.CreatePattern("verse", 16)
+	seq.AddTo("verse", 1, NewNote("kick", 60, 100))
+	seq.SetSong([]SongEntry{{"verse", 1}, {"main", 2}})
+	bank := seq.Bank()
+
+	other := newSequencer(newNullEngine(), newVirtualClock(), 16, 120)
+	err := other.SetBank(bank)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, other.Patterns(), []string{"main", "verse"})
+	assert.Equal(t, other.Song(), bank.Song)
+	assert.Equal(t, other.Playing(), "verse")
+	assert.Equal(t, len(other.NotesAt("verse", 1)), 1)
+
+	err = other.SetBank(&Bank{Patterns: []*Pattern{}})
+	assert.Equal(t, err.Error(), "bank has no patterns")
+}
+
+func TestSequencerSetBankInvalid(t *testing.T) {
+	seq := newSequencer(newNullEngine(), newVirtualClock(), 16, 120)
+	banks := map[string]string{
+		`{"patterns":[{"name":"main","length":1,"notes":[[{"sample":"kick","track":-1}]]}]}`:           "pattern main: pos 0: track (-1) does not exist in pattern with 0 tracks",
+		`{"patterns":[{"name":"main","length":1,"notes":[[{"sample":"kick","track":1}]]}]}`:            "pattern main: pos 0: track (1) does not exist in pattern with 0 tracks",
+		`{"patterns":[{"name":"main","length":1,"notes":[[]],"tracks":[null]}]}`:                       "pattern main: track 0 can not be nil",
+		`{"patterns":[{"name":"main","length":1,"notes":[[{"sample":"kick","duration":-1}]]}]}`:        "pattern main: pos 0: note duration (-1) can not be negative",
+		`{"patterns":[{"name":"main","length":1,"notes":[[]],"groove":{"name":"mpc","offsets":[2]}}]}`: "pattern main: groove offset 0 (2) must be from 0 up to 1",
+		`{"patterns":[{"name":"main","length":1,"notes":[[]]},null]}`:                                  "pattern 1 can not be nil",
+		`{"patterns":[{"name":"main","length":100000,"notes":[[]]}]}`:                                  "pattern length (100000) can not be greater than 65536",
+	}
+	for js, msg := range banks {
+		bank := new(Bank)
+		err := json.Unmarshal([]byte(js), bank)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = seq.SetBank(bank)
+		assert.Equal(t, err.Error(), msg)
+	}
+	// the sequencer still plays the bank it had
+	assert.Equal(t, seq.Playing(), "main")
+	steps(t, seq, 2)
+
+	// removed notes leave empty slots, which are kept
+	bank := new(Bank)
+	json.Unmarshal([]byte(`{"patterns":[{"name":"main","length":1,"notes":[[null,{"sample":"kick"}]],"tracks":[{"name":"a"}]}]}`), bank)
+	err := seq.SetBank(bank)
+	assert.Equal(t, err, nil)
+	steps(t, seq, 1)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultPeaks is the number of peaks in a waveform
+	// summary if the client does not ask for a number
+	defaultPeaks = 512
+	// maxPeaks is the largest number of peaks in a
+	// waveform summary
+	maxPeaks = 65536
+)
+
+// sampleTypes are the content types of the sample formats
+var sampleTypes = map[string]string{
+	"wav":  "audio/wav",
+	"flac": "audio/flac",
+	"aiff": "audio/aiff",
+}
+
+// Peaks summarizes the waveform of a sample for drawing. The
+// frames of the sample are split into equal spans, and Peaks holds
+// the lowest and highest sample of every span, from -1 to 1, across
+// both channels. Span is the number of frames in a span, the last
+// span can be shorter.
+type Peaks struct {
+	Rate   int          `json:"rate"`
+	Frames int          `json:"frames"`
+	Span   int          `json:"span"`
+	Peaks  [][2]float32 `json:"peaks"`
+}
+
+// peaks returns a summary of the waveform of a WAV sample with at
+// most n peaks. Samples shorter than n frames have one peak per frame.
+func (self *samples) peaks(name string, n int) (*Peaks, error) {
+	samplePath, exists := self.lookup(name)
+	if !exists {
+		return nil, &requestError{codeNotFound, fmt.Sprintf("sample %s does not exist", name)}
+	}
+	if format := sampleFormat(samplePath); format != "wav" {
+		return nil, &requestError{codeInvalid, fmt.Sprintf("peaks of %s files are not supported", format)}
+	}
+	file, eo := os.Open(samplePath)
+	if eo != nil {
+		return nil, eo
+	}
+	defer file.Close()
+	buf, er := readWav(file)
+	if er != nil {
+		return nil, fmt.Errorf("sample %s: %s", name, er)
+	}
+	span := int(math.Ceil(float64(len(buf.frames)) / float64(n)))
+	if span < 1 {
+		span = 1
+	}
+	peaks := &Peaks{buf.rate, len(buf.frames), span, make([][2]float32, 0, n)}
+	for start := 0; start < len(buf.frames); start += span {
+		end := start + span
+		if end > len(buf.frames) {
+			end = len(buf.frames)
+		}
+		peak := [2]float32{1, -1}
+		for _, frame := range buf.frames[start:end] {
+			for _, s := range frame {
+				peak[0] = float32(math.Min(float64(peak[0]), float64(s)))
+				peak[1] = float32(math.Max(float64(peak[1]), float64(s)))
+			}
+		}
+		peaks.Peaks = append(peaks.Peaks, peak)
+	}
+	return peaks, nil
+}
+
+// serve writes the file of a sample to w, with the content type
+// of its format. Range and conditional requests are supported,
+// so browsers can seek in a sample and cache it.
+func (self *samples) serve(w http.ResponseWriter, r *http.Request, name string) error {
+	samplePath, exists := self.lookup(name)
+	if !exists {
+		return &requestError{codeNotFound, fmt.Sprintf("sample %s does not exist", name)}
+	}
+	file, eo := os.Open(samplePath)
+	if eo != nil {
+		return eo
+	}
+	defer file.Close()
+	info, es := file.Stat()
+	if es != nil {
+		return es
+	}
+	w.Header().Set("Content-Type", sampleTypes[sampleFormat(samplePath)])
+	http.ServeContent(w, r, path.Base(samplePath), info.ModTime(), file)
+	return nil
+}
+
+// sample returns an http handler for a sample, named by the path
+// after /samples/. GET responds with the sample file, or with the
+// JSON Peaks of its waveform if the peaks query parameter is
+// set to the number of peaks, or is empty for defaultPeaks.
+// DELETE deletes the sample, which must not be played by a pattern
+// unless the force query parameter is true.
+func (self *server) sample() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		name := strings.TrimPrefix(r.URL.Path, "/samples/")
+		query := r.URL.Query()
+		switch r.Method {
+		case "GET", "HEAD":
+			if _, summary := query["peaks"]; !summary {
+				err = self.samples.serve(w, r, name)
+				break
+			}
+			n := defaultPeaks
+			if query.Get("peaks") != "" {
+				n, err = strconv.Atoi(query.Get("peaks"))
+				if err != nil || n < 1 || n > maxPeaks {
+					msg := fmt.Sprintf("peaks must be a number from 1 to %d", maxPeaks)
+					err = &requestError{codeInvalid, msg}
+					break
+				}
+			}
+			var peaks *Peaks
+			peaks, err = self.samples.peaks(name, n)
+			if err == nil {
+				err = respondJSON(w, http.StatusOK, peaks)
+			}
+		case "DELETE":
+			err = self.deleteSample(name, query.Get("force") == "true")
+			if err == nil {
+				w.WriteHeader(http.StatusNoContent)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("method not allowed"))
+		}
+		if err != nil {
+			w.WriteHeader(httpStatus(err))
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSampleStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wav := new(bytes.Buffer)
+	writeWav(wav, &audioBuffer{8000, [][2]float32{{0.5, -0.5}, {0.25, 0}, {0, 0}, {-1, 1}, {0.5, 0.5}}})
+	os.Mkdir(filepath.Join(dir, "808"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "808/kick.wav"), wav.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "snare.flac"), flacHeader(44100, 2, 16, 441), 0644)
+	srv := newTestServer(t)
+	err = srv.readSamples(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := srv.sample()
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/samples/808/kick", nil))
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, w.Header().Get("Content-Type"), "audio/wav")
+	assert.Equal(t, w.Header().Get("Accept-Ranges"), "bytes")
+	assert.Equal(t, w.Body.Bytes(), wav.Bytes())
+
+	r := httptest.NewRequest("GET", "/samples/snare", nil)
+	r.Header.Set("Range", "bytes=0-3")
+	w = httptest.NewRecorder()
+	handler(w, r)
+	assert.Equal(t, w.Code, http.StatusPartialContent)
+	assert.Equal(t, w.Header().Get("Content-Type"), "audio/flac")
+	assert.Equal(t, w.Header().Get("Content-Range"), "bytes 0-3/42")
+	assert.Equal(t, w.Body.String(), "fLaC")
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/samples/808/kick?peaks=2", nil))
+	assert.Equal(t, w.Code, http.StatusOK)
+	peaks := new(Peaks)
+	err = json.Unmarshal(w.Body.Bytes(), peaks)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, peaks.Rate, 8000)
+	assert.Equal(t, peaks.Frames, 5)
+	assert.Equal(t, peaks.Span, 3)
+	assert.Equal(t, len(peaks.Peaks), 2)
+	// 16 bit samples are not exactly -1, 1 and 0.5
+	assert.Equal(t, peaks.Peaks[1][0] < -0.99 && peaks.Peaks[1][1] > 0.99, true)
+	assert.Equal(t, peaks.Peaks[0][0] > -0.51 && peaks.Peaks[0][0] < -0.49, true)
+	assert.Equal(t, peaks.Peaks[0][1] > 0.49 && peaks.Peaks[0][1] < 0.51, true)
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/samples/808/kick?peaks", nil))
+	peaks = new(Peaks)
+	json.Unmarshal(w.Body.Bytes(), peaks)
+	assert.Equal(t, len(peaks.Peaks), 5)
+
+	failures := map[string]int{
+		"/samples/808/kick?peaks=0": http.StatusBadRequest,
+		"/samples/808/kick?peaks=x": http.StatusBadRequest,
+		"/samples/snare?peaks=10":   http.StatusBadRequest,
+		"/samples/clap":             http.StatusNotFound,
+		"/samples/clap?peaks":       http.StatusNotFound,
+	}
+	for url, status := range failures {
+		w = httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, w.Code, status)
+	}
+}
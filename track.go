@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// maxVelocity is the largest note velocity
+const maxVelocity = 127
+
+// Track is a group of notes in a pattern that are
+// muted, soloed and mixed together.
+// Notes on a track that do not have a sample play
+// the track's sample. Gain is in dB and is applied to
+// the velocity of every note on the track.
+type Track struct {
+	Name   string  `json:"name"`
+	Sample string  `json:"sample,omitempty"`
+	Mute   bool    `json:"mute,omitempty"`
+	Solo   bool    `json:"solo,omitempty"`
+	Gain   float64 `json:"gain,omitempty"`
+}
+
+func (self *Pattern) noSuchTrack(index int) error {
+	str := "track (%d) does not exist in pattern with %d tracks"
+	return fmt.Errorf(str, index, len(self.Tracks))
+}
+
+// validNote returns an error if a note is on a track that
+// the pattern does not have or has a negative duration. Notes
+// on track 0 are valid in a pattern without tracks.
+func (self *Pattern) validNote(note *Note) error {
+	if note.Track < 0 || (note.Track != 0 && note.Track >= len(self.Tracks)) {
+		return self.noSuchTrack(note.Track)
+	}
+	if note.Duration < 0 {
+		return fmt.Errorf("note duration (%d) can not be negative", note.Duration)
+	}
+	return nil
+}
+
+// validTracks returns an error if a track of the pattern is
+// nil or a note is not valid, see validNote
+func (self *Pattern) validTracks() error {
+	for i, track := range self.Tracks {
+		if track == nil {
+			return fmt.Errorf("track %d can not be nil", i)
+		}
+	}
+	for pos, notes := range self.Notes {
+		for _, note := range notes {
+			if note == nil {
+				continue
+			}
+			err := self.validNote(note)
+			if err != nil {
+				return fmt.Errorf("pos %d: %s", pos, err)
+			}
+		}
+	}
+	return nil
+}
+
+// AddTrack adds a track to the end of the pattern's tracks
+func (self *Pattern) AddTrack(track *Track) error {
+	if track == nil {
+		return errors.New("track can not be nil")
+	}
+	self.Tracks = append(self.Tracks, track)
+	return nil
+}
+
+// SetTrack replaces the track at index
+func (self *Pattern) SetTrack(index int, track *Track) error {
+	if track == nil {
+		return errors.New("track can not be nil")
+	}
+	if index < 0 || index >= len(self.Tracks) {
+		return self.noSuchTrack(index)
+	}
+	self.Tracks[index] = track
+	return nil
+}
+
+// DeleteTrack removes the track at index along with all
+// of its notes. Notes on the following tracks move down
+// one track.
+func (self *Pattern) DeleteTrack(index int) error {
+	if index < 0 || index >= len(self.Tracks) {
+		return self.noSuchTrack(index)
+	}
+	self.Tracks = append(self.Tracks[:index], self.Tracks[index+1:]...)
+	for pos, notes := range self.Notes {
+		kept := make([]*Note, 0, len(notes))
+		for _, note := range notes {
+			if note == nil || note.Track == index {
+				continue
+			}
+			if note.Track > index {
+				moved := *note
+				moved.Track -= 1
+				note = &moved
+			}
+			kept = append(kept, note)
+		}
+		self.Notes[pos] = kept
+	}
+	return nil
+}
+
+// soloed returns true if any of the pattern's tracks are soloed
+func (self *Pattern) soloed() bool {
+	for _, track := range self.Tracks {
+		if track.Solo {
+			return true
+		}
+	}
+	return false
+}
+
+// mix returns copies of notes with the settings of their
+// tracks applied, ready to be sent to the engine.
+// Notes on muted tracks, and on tracks that are not soloed
+// when another track is, are left out.
+func (self *Pattern) mix(notes []*Note) []*Note {
+	solo := self.soloed()
+	mixed := make([]*Note, 0, len(notes))
+	for _, note := range notes {
+		if note == nil {
+			continue
+		}
+		n := *note
+		if note.Track >= len(self.Tracks) {
+			// notes on the implicit first track of a
+			// pattern without tracks play as they are
+			if !solo {
+				mixed = append(mixed, &n)
+			}
+			continue
+		}
+		track := self.Tracks[note.Track]
+		if track.Mute || (solo && !track.Solo) {
+			continue
+		}
+		if n.Sample == "" {
+			n.Sample = track.Sample
+		}
+		n.Velocity = applyGain(n.Velocity, track.Gain)
+		mixed = append(mixed, &n)
+	}
+	return mixed
+}
+
+// applyGain scales a velocity by a gain in dB
+func applyGain(velocity int32, gain float64) int32 {
+	if gain == 0 {
+		return velocity
+	}
+	return scaleVelocity(velocity, math.Pow(10, gain/20))
+}
+
+// scaleVelocity multiplies a velocity by scale, keeping
+// it in the range of valid velocities
+func scaleVelocity(velocity int32, scale float64) int32 {
+	if scale == 1 {
+		return velocity
+	}
+	v := math.Floor(float64(velocity)*scale + 0.5)
+	return int32(math.Max(0, math.Min(maxVelocity, v)))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"testing"
+)
+
+// trackNote creates a note on a track
+func trackNote(sample string, number, velocity int32, track int) *Note {
+	note := NewNote(sample, number, velocity)
+	note.Track = track
+	return note
+}
+
+func TestPatternAddToTrack(t *testing.T) {
+	pat := NewPattern(4)
+	err := pat.AddTo(0, trackNote("kick", 60, 100, 1))
+	assert.Equal(t, err.Error(), "track (1) does not exist in pattern with 0 tracks")
+	err = pat.AddTo(0, trackNote("kick", 60, 100, -1))
+	assert.Equal(t, err.Error(), "track (-1) does not exist in pattern with 0 tracks")
+	pat.AddTrack(&Track{Name: "kick"})
+	pat.AddTrack(&Track{Name: "hats"})
+	err = pat.AddTo(0, trackNote("kick", 60, 100, 1))
+	assert.Equal(t, err, nil)
+	// removing a note only matches notes on the same track
+	pat.RemoveFrom(0, trackNote("kick", 60, 0, 0))
+	assert.Equal(t, pat.NotesAt(0)[0].Track, 1)
+}
+
+func TestPatternMix(t *testing.T) {
+	pat := NewPattern(1)
+	pat.AddTrack(&Track{Name: "kick", Sample: "kick.wav"})
+	pat.AddTrack(&Track{Name: "hats", Gain: -6})
+	pat.AddTrack(&Track{Name: "snare", Mute: true})
+	pat.AddTo(0, trackNote("", 60, 100, 0))
+	pat.AddTo(0, trackNote("hat.wav", 62, 100, 1))
+	pat.AddTo(0, trackNote("snare.wav", 64, 100, 2))
+
+	mixed := pat.mix(pat.NotesAt(0))
+	assert.Equal(t, len(mixed), 2)
+	// notes without a sample play the track's sample
+	assert.Equal(t, mixed[0].Sample, "kick.wav")
+	assert.Equal(t, mixed[0].Velocity, int32(100))
+	// gain is applied to velocity
+	assert.Equal(t, mixed[1].Sample, "hat.wav")
+	assert.Equal(t, mixed[1].Velocity, int32(50))
+	// the pattern's notes are not changed
+	assert.Equal(t, pat.NotesAt(0)[0].Sample, "")
+
+	// only soloed tracks play when a track is soloed
+	pat.Tracks[1].Solo = true
+	mixed = pat.mix(pat.NotesAt(0))
+	assert.Equal(t, len(mixed), 1)
+	assert.Equal(t, mixed[0].Sample, "hat.wav")
+}
+
+func TestApplyGain(t *testing.T) {
+	assert.Equal(t, applyGain(100, 0), int32(100))
+	assert.Equal(t, applyGain(100, 6), int32(127))
+	assert.Equal(t, applyGain(32, 6), int32(64))
+	assert.Equal(t, applyGain(100, -200), int32(0))
+}
+
+func TestPatternDeleteTrack(t *testing.T) {
+	pat := NewPattern(2)
+	pat.AddTrack(&Track{Name: "kick"})
+	pat.AddTrack(&Track{Name: "snare"})
+	pat.AddTrack(&Track{Name: "hats"})
+	pat.AddTo(0, trackNote("kick.wav", 60, 100, 0))
+	pat.AddTo(0, trackNote("snare.wav", 60, 100, 1))
+	pat.AddTo(1, trackNote("hat.wav", 60, 100, 2))
+
+	err := pat.DeleteTrack(1)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(pat.Tracks), 2)
+	assert.Equal(t, pat.Tracks[1].Name, "hats")
+	assert.Equal(t, len(pat.NotesAt(0)), 1)
+	assert.Equal(t, pat.NotesAt(1)[0].Track, 1)
+
+	err = pat.DeleteTrack(2)
+	assert.Equal(t, err.Error(), "track (2) does not exist in pattern with 2 tracks")
+	err = pat.DeleteTrack(-1)
+	assert.Equal(t, err.Error(), "track (-1) does not exist in pattern with 2 tracks")
+}
+
+func TestPatternTracksJson(t *testing.T) {
+	pat := NewPattern(1)
+	pat.AddTrack(&Track{Name: "kick", Sample: "kick.wav", Mute: true, Gain: -3})
+	pat.AddTrack(&Track{Name: "hats"})
+	pat.AddTo(0, trackNote("hat.wav", 62, 90, 1))
+	expected := []byte(`{"length":1,"notes":[[{"sample":"hat.wav","number":62,"velocity":90,"track":1}]],"tracks":[{"name":"kick","sample":"kick.wav","mute":true,"gain":-3},{"name":"hats"}]}`)
+	bs, err := json.Marshal(pat)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, string(bs), string(expected))
+
+	decoded := new(Pattern)
+	err = json.Unmarshal(bs, decoded)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, decoded, pat)
+}
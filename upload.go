@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxUpload is the largest sample file that can be uploaded
+const maxUpload = 256 << 20
+
+// store writes a sample file read from r to folder in the sample
+// directory and returns the name of the sample. The file must have
+// a supported extension and a header that can be read, and must
+// not replace a sample. It is added to the pool when the sample
+// directory is rescanned.
+func (self *samples) store(folder, filename string, r io.Reader) (string, error) {
+	self.mu.Lock()
+	dir := self.dir
+	self.mu.Unlock()
+	if dir == "" {
+		return "", errors.New("there is no sample directory")
+	}
+	folder = strings.Trim(filepath.ToSlash(folder), "/")
+	for _, elem := range strings.Split(folder, "/") {
+		// folders can not be hidden or outside dir
+		if folder != "" && (elem == "" || strings.HasPrefix(elem, ".")) {
+			return "", &requestError{codeInvalid, fmt.Sprintf("folder %s is not valid", folder)}
+		}
+	}
+	base := path.Base(strings.Replace(filename, "\\", "/", -1))
+	if strings.HasPrefix(base, ".") || !isSupported(base) {
+		msg := fmt.Sprintf("%s is not a sample file, sample files end with %s",
+			base, strings.Join(supportedExtensions, ", "))
+		return "", &requestError{codeInvalid, msg}
+	}
+	rel := path.Join(folder, base)
+	name := strings.TrimSuffix(rel, path.Ext(rel))
+	target := filepath.Join(dir, filepath.FromSlash(rel))
+	_, es := os.Stat(target)
+	if _, exists := self.lookup(name); exists || es == nil {
+		return "", &requestError{codeConflict, fmt.Sprintf("sample %s already exists", name)}
+	}
+	em := os.MkdirAll(filepath.Dir(target), 0755)
+	if em != nil {
+		return "", em
+	}
+	// the file is hidden until it has been checked,
+	// so a rescan does not add it to the pool
+	tmp, et := ioutil.TempFile(filepath.Dir(target), ".upload-*"+path.Ext(base))
+	if et != nil {
+		return "", et
+	}
+	_, ew := io.Copy(tmp, r)
+	ec := tmp.Close()
+	if ew == nil {
+		ew = ec
+	}
+	if ew == nil {
+		_, er := readSampleInfo(tmp.Name())
+		if er != nil {
+			msg := fmt.Sprintf("%s is not a valid %s file: %s", base, sampleFormat(base), er)
+			ew = &requestError{codeInvalid, msg}
+		}
+	}
+	if ew == nil {
+		ew = os.Rename(tmp.Name(), target)
+	}
+	if ew != nil {
+		os.Remove(tmp.Name())
+		return "", ew
+	}
+	return name, nil
+}
+
+// remove deletes the file of a sample and its tags. Removing a
+// region deletes its definition, and removing a sample file deletes
+// the regions that are made of it. The sample is removed from the
+// pool when the sample directory is rescanned.
+func (self *samples) remove(name string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	samplePath, exists := self.pool[name]
+	if !exists {
+		return &requestError{codeNotFound, fmt.Sprintf("sample %s does not exist", name)}
+	}
+	er := os.Remove(samplePath)
+	if er != nil {
+		return er
+	}
+	removed := make([]string, 0)
+	if self.files[name].info.Region != nil {
+		removed = append(removed, name)
+	} else {
+		for regionName, region := range self.regions {
+			if region.Sample == name {
+				removed = append(removed, regionName)
+				self.removeRegion(regionName)
+			}
+		}
+	}
+	for _, regionName := range removed {
+		delete(self.regions, regionName)
+	}
+	if len(removed) > 0 {
+		es := self.saveRegions()
+		if es != nil {
+			return es
+		}
+	}
+	if _, tagged := self.tags[name]; tagged {
+		delete(self.tags, name)
+		return self.saveTags()
+	}
+	return nil
+}
+
+// uploadSample stores the sample file in the file field of a
+// multipart form in the folder named by its folder field, adds
+// it to the pool and returns its SampleInfo
+func (self *server) uploadSample(r *http.Request) (SampleInfo, error) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return SampleInfo{}, &requestError{codeInvalid, "upload requires a file: " + err.Error()}
+	}
+	defer file.Close()
+	name, err := self.samples.store(r.FormValue("folder"), header.Filename, file)
+	if err != nil {
+		return SampleInfo{}, err
+	}
+	_, err = self.rescanSamples()
+	if err != nil {
+		return SampleInfo{}, err
+	}
+	info, exists := self.samples.info(name)
+	if !exists {
+		return SampleInfo{}, fmt.Errorf("sample %s was removed while it was uploaded", name)
+	}
+	return info, nil
+}
+
+// sampleFiles returns an http handler that lists the samples (GET)
+// or uploads a sample file (POST) as a multipart form. An upload
+// responds with the SampleInfo of the new sample.
+func (self *server) sampleFiles() http.HandlerFunc {
+	list := self.samples.list()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			list(w, r)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxUpload)
+		info, err := self.uploadSample(r)
+		if err == nil {
+			err = respondJSON(w, http.StatusCreated, info)
+		}
+		if err != nil {
+			w.WriteHeader(httpStatus(err))
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
+
+// deleteSample deletes the file of a sample and removes the sample
+// from the pool. A sample that is played by a pattern, or whose
+// regions are, is only deleted if force is true.
+func (self *server) deleteSample(name string, force bool) error {
+	if !force {
+		for _, played := range append([]string{name}, self.samples.regionsOf(name)...) {
+			users := self.seq.PatternsUsing(played)
+			if len(users) == 0 {
+				continue
+			}
+			what := "sample " + name
+			if played != name {
+				what = fmt.Sprintf("region %s of sample %s", played, name)
+			}
+			msg := fmt.Sprintf("%s is played by %s, use force=true to delete it anyway",
+				what, strings.Join(users, ", "))
+			return &requestError{codeConflict, msg}
+		}
+	}
+	err := self.samples.remove(name)
+	if err != nil {
+		return err
+	}
+	_, err = self.rescanSamples()
+	return err
+}
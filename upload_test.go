@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// uploadRequest returns a request that uploads a sample file
+func uploadRequest(folder, filename string, bs []byte) *http.Request {
+	body := new(bytes.Buffer)
+	form := multipart.NewWriter(body)
+	if folder != "" {
+		form.WriteField("folder", folder)
+	}
+	part, _ := form.CreateFormFile("file", filename)
+	part.Write(bs)
+	form.Close()
+	r := httptest.NewRequest("POST", "/samples", body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	return r
+}
+
+func TestSampleUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wav := new(bytes.Buffer)
+	writeWav(wav, &audioBuffer{44100, make([][2]float32, 441)})
+	ioutil.WriteFile(filepath.Join(dir, "kick.wav"), wav.Bytes(), 0644)
+	srv := newTestServer(t)
+	err = srv.readSamples(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := srv.hub.subscribe()
+	handler := srv.sampleFiles()
+
+	w := httptest.NewRecorder()
+	handler(w, uploadRequest("808/snares", `C:\samples\snare.wav`, wav.Bytes()))
+	assert.Equal(t, w.Code, http.StatusCreated)
+	var info SampleInfo
+	err = json.Unmarshal(w.Body.Bytes(), &info)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, info.Name, "808/snares/snare")
+	assert.Equal(t, info.Duration, 0.01)
+	up := <-updates
+	assert.Equal(t, up.Samples, []PoolChange{{Type: poolAdd, Name: "808/snares/snare"}})
+	_, exists := srv.samples.lookup("808/snares/snare")
+	assert.Equal(t, exists, true)
+
+	failures := []struct {
+		folder, filename string
+		bs               []byte
+		status           int
+		message          string
+	}{
+		{"", "kick.wav", wav.Bytes(), http.StatusConflict, "sample kick already exists"},
+		{"", "notes.txt", []byte("notes"), http.StatusBadRequest,
+			"notes.txt is not a sample file, sample files end with .wav, .flac, .aif, .aiff"},
+		{"", "tom.wav", []byte("RIFF"), http.StatusBadRequest, "tom.wav is not a valid wav file: not a wav file"},
+		{"../..", "tom.wav", wav.Bytes(), http.StatusBadRequest, "folder ../.. is not valid"},
+	}
+	for _, f := range failures {
+		w = httptest.NewRecorder()
+		handler(w, uploadRequest(f.folder, f.filename, f.bs))
+		assert.Equal(t, w.Code, f.status)
+		assert.Equal(t, w.Body.String(), f.message)
+	}
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/samples", strings.NewReader("kick")))
+	assert.Equal(t, w.Code, http.StatusBadRequest)
+	// rejected files are not left behind
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, len(files), 2)
+	assert.Equal(t, len(updates), 0)
+}
+
+func TestSampleDelete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "808"), 0755)
+	for _, name := range []string{"kick.flac", "808/snare.flac"} {
+		ioutil.WriteFile(filepath.Join(dir, name), flacHeader(44100, 2, 16, 441), 0644)
+	}
+	srv := newTestServer(t)
+	err = srv.readSamples(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.seq.CreatePattern("verse", 16)
+	srv.seq.AddTo("verse", 4, NewNote("808/snare", 60, 100))
+	handler := srv.sample()
+
+	// a track's default sample is played by its pattern
+	srv.seq.AddTrack("", &Track{Name: "kick", Sample: "kick"})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("DELETE", "/samples/kick", nil))
+	assert.Equal(t, w.Code, http.StatusConflict)
+	assert.Equal(t, w.Body.String(), "sample kick is played by main, use force=true to delete it anyway")
+	srv.seq.DeleteTrack("", 0)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("DELETE", "/samples/kick", nil))
+	assert.Equal(t, w.Code, http.StatusNoContent)
+	_, exists := srv.samples.lookup("kick")
+	assert.Equal(t, exists, false)
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("DELETE", "/samples/808/snare", nil))
+	assert.Equal(t, w.Code, http.StatusConflict)
+	assert.Equal(t, w.Body.String(), "sample 808/snare is played by verse, use force=true to delete it anyway")
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("DELETE", "/samples/808/snare?force=true", nil))
+	assert.Equal(t, w.Code, http.StatusNoContent)
+	_, err = os.Stat(filepath.Join(dir, "808/snare.flac"))
+	assert.Equal(t, os.IsNotExist(err), true)
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("DELETE", "/samples/clap", nil))
+	assert.Equal(t, w.Code, http.StatusNotFound)
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("PUT", "/samples/clap", nil))
+	assert.Equal(t, w.Code, http.StatusMethodNotAllowed)
+}
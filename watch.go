@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// watchSettle is how long the sample directory has to be left
+// alone after a change before it is rescanned, so files that are
+// being copied into it are read once they are complete
+const watchSettle = 250 * time.Millisecond
+
+// types of changes to the sample pool
+const (
+	poolAdd    = "add"
+	poolRemove = "remove"
+	poolRename = "rename"
+)
+
+// PoolChange is a sample that was added to, removed from or
+// renamed in the sample pool. From is the old name of a
+// renamed sample.
+type PoolChange struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+	From string `json:"from,omitempty"`
+}
+
+// poolChanges sorts changes by name
+type poolChanges []PoolChange
+
+func (self poolChanges) Len() int {
+	return len(self)
+}
+
+func (self poolChanges) Less(i, j int) bool {
+	return self[i].Name < self[j].Name
+}
+
+func (self poolChanges) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+// rescan reads the sample directory again and updates the pool
+// with the files that were added, removed or renamed since it was
+// last read, see update
+func (self *samples) rescan() ([]PoolChange, error) {
+	self.scanning.Lock()
+	defer self.scanning.Unlock()
+	files, moved, err := self.scan()
+	if err != nil {
+		return nil, err
+	}
+	return self.update(files, moved), nil
+}
+
+// scan reads the sample directory and adds the regions of its
+// samples, without changing the pool. It returns true if regions
+// followed their renamed samples. The caller must hold scanning,
+// so the pool does not change until the scan is applied by update.
+func (self *samples) scan() (map[string]*sampleFile, bool, error) {
+	self.mu.Lock()
+	dir, old := self.dir, self.files
+	self.mu.Unlock()
+	files, err := scanSamples(dir, old)
+	if err != nil {
+		return nil, false, err
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return files, self.scanRegions(files, old), nil
+}
+
+// update replaces the pool with the files of a scan and returns
+// the changes to the pool. A file that replaces a sample with the
+// same name is reported as added. The tags of a renamed sample
+// are moved to its new name. The caller must hold scanning.
+func (self *samples) update(files map[string]*sampleFile, moved bool) []PoolChange {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	added, removed := make([]string, 0), make(map[string]*sampleFile)
+	for name, file := range self.files {
+		if _, exists := files[name]; !exists {
+			removed[name] = file
+		}
+	}
+	for name, file := range files {
+		prev, exists := self.files[name]
+		if !exists || prev.path != file.path || !os.SameFile(prev.stat, file.stat) {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	changes, retagged := make([]PoolChange, 0), false
+	for _, name := range added {
+		change := PoolChange{Type: poolAdd, Name: name}
+		for from, file := range removed {
+			if os.SameFile(file.stat, files[name].stat) {
+				change = PoolChange{poolRename, name, from}
+				delete(removed, from)
+				if tags, exists := self.tags[from]; exists {
+					self.tags[name] = tags
+					delete(self.tags, from)
+					retagged = true
+				}
+				break
+			}
+		}
+		changes = append(changes, change)
+	}
+	for name, _ := range removed {
+		changes = append(changes, PoolChange{Type: poolRemove, Name: name})
+	}
+	sort.Stable(poolChanges(changes))
+	self.files = files
+	self.pool = make(map[string]string, len(files))
+	for name, file := range files {
+		self.pool[name] = filepath.Join(self.dir, filepath.FromSlash(file.path))
+	}
+	if retagged {
+		es := self.saveTags()
+		if es != nil {
+			log.Printf("could not save tags: %s\n", es)
+		}
+	}
+	if moved {
+		es := self.saveRegions()
+		if es != nil {
+			log.Printf("could not save regions: %s\n", es)
+		}
+	}
+	return changes
+}
+
+// rescanSamples reads the sample directory again and broadcasts
+// the changes to the sample pool to every client. The directory
+// is read before the hub is held, so clients are not kept waiting
+// while a large library is scanned.
+func (self *server) rescanSamples() ([]PoolChange, error) {
+	self.samples.scanning.Lock()
+	defer self.samples.scanning.Unlock()
+	files, moved, err := self.samples.scan()
+	if err != nil {
+		return nil, err
+	}
+	var changes []PoolChange
+	err = self.hub.publish(func() (*Update, error) {
+		changes = self.samples.update(files, moved)
+		if len(changes) == 0 {
+			return nil, nil
+		}
+		return &Update{Type: updateSamples, Samples: changes}, nil
+	})
+	return changes, err
+}
+
+// watchSamples rescans the sample directory every interval,
+// until stop is closed
+func (self *server) watchSamples(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			_, err := self.rescanSamples()
+			if err != nil {
+				log.Printf("could not rescan samples: %s\n", err)
+			}
+		}
+	}
+}
+
+// watch keeps the sample pool up to date with the sample
+// directory, so files that are added to it, removed from it or
+// renamed show up without a restart. The directory is watched for
+// changes where the platform supports it. Elsewhere, or if it can
+// not be watched, e.g. because the limit of inotify watches has
+// been reached, it is polled every interval. Polling is disabled
+// if the interval is 0.
+func (self *server) watch(interval time.Duration) {
+	self.stopWatch = make(chan bool)
+	err := self.notifySamples(self.stopWatch)
+	if err == nil {
+		return
+	}
+	if interval <= 0 {
+		log.Printf("not watching the sample directory: %s\n", err)
+		return
+	}
+	log.Printf("polling the sample directory every %s: %s\n", interval, err)
+	go self.watchSamples(interval, self.stopWatch)
+}
+
+// rescan returns an http handler that rescans the sample
+// directory (POST) and responds with the changes to the pool
+func (self *server) rescan() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		var changes []PoolChange
+		status := http.StatusInternalServerError
+		if r.Method != "POST" {
+			err = errors.New("method not allowed")
+			status = http.StatusMethodNotAllowed
+		} else if changes, err = self.rescanSamples(); err == nil {
+			err = respondJSON(w, http.StatusOK, changes)
+		}
+		if err != nil {
+			w.WriteHeader(status)
+			w.Write([]byte(err.Error()))
+		}
+	}
+}
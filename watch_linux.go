@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// inotifyMask are the changes to the sample directory
+// that make it be rescanned
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// notifySamples rescans the sample directory when inotify reports
+// a change to a file in it or in one of its subdirectories, until
+// stop is closed. Changes to hidden files, like the regions file
+// or an upload that has not been checked yet, are ignored.
+func (self *server) notifySamples(stop chan bool) error {
+	fd, ei := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if ei != nil {
+		return os.NewSyscallError("inotify_init1", ei)
+	}
+	// a non-blocking file is read through the runtime poller,
+	// so closing it ends a read that is waiting for changes
+	file := os.NewFile(uintptr(fd), "inotify")
+	self.samples.mu.Lock()
+	dir := self.samples.dir
+	self.samples.mu.Unlock()
+	ew := watchDirs(fd, dir)
+	if ew != nil {
+		file.Close()
+		return ew
+	}
+	changed := make(chan bool, 1)
+	go readInotify(file, changed)
+	go func() {
+		defer file.Close()
+		var settle <-chan time.Time
+		for {
+			select {
+			case <-stop:
+				return
+			case <-changed:
+				settle = time.After(watchSettle)
+			case <-settle:
+				settle = nil
+				// watch the directories that were added
+				ew := watchDirs(fd, dir)
+				if ew != nil {
+					log.Printf("could not watch the sample directory: %s\n", ew)
+				}
+				_, err := self.rescanSamples()
+				if err != nil {
+					log.Printf("could not rescan samples: %s\n", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// readInotify reads inotify events from file and sends on changed
+// when a file that is not hidden changed, until file is closed
+func readInotify(file *os.File, changed chan bool) {
+	buf := make([]byte, 64<<10)
+	for {
+		n, er := file.Read(buf)
+		if er != nil {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			size := int(event.Len)
+			start := off + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[start:start+size]), "\x00")
+			off = start + size
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			select {
+			case changed <- true:
+			default:
+			}
+		}
+	}
+}
+
+// watchDirs adds an inotify watch for dir and each of its
+// subdirectories that is not hidden. Directories that are
+// already watched keep their watch.
+func watchDirs(fd int, dir string) error {
+	return filepath.Walk(dir, func(f string, stat os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			return nil
+		}
+		if f != dir && strings.HasPrefix(stat.Name(), ".") {
+			return filepath.SkipDir
+		}
+		_, ea := syscall.InotifyAddWatch(fd, f, inotifyMask)
+		if ea != nil {
+			return os.NewSyscallError("inotify_add_watch "+f, ea)
+		}
+		return nil
+	})
+}
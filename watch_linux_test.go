@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wav := new(bytes.Buffer)
+	writeWav(wav, &audioBuffer{44100, nil})
+	ioutil.WriteFile(filepath.Join(dir, "kick.wav"), wav.Bytes(), 0644)
+	srv := newTestServer(t)
+	err = srv.readSamples(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := srv.hub.subscribe()
+	srv.watch(0)
+	defer close(srv.stopWatch)
+
+	// files in new subdirectories are noticed too
+	os.Mkdir(filepath.Join(dir, "808"), 0755)
+	time.Sleep(2 * watchSettle)
+	ioutil.WriteFile(filepath.Join(dir, "808/snare.wav"), wav.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(dir, ".snare.wav"), wav.Bytes(), 0644)
+	select {
+	case up := <-updates:
+		assert.Equal(t, up.Type, updateSamples)
+		assert.Equal(t, up.Samples, []PoolChange{{Type: poolAdd, Name: "808/snare"}})
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update after adding a sample")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// notifySamples can not watch the sample directory for
+// changes on this platform, so it is polled instead
+func (self *server) notifySamples(stop chan bool) error {
+	return errors.New("watching for changes is only supported on linux")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bmizerany/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSamplesRescan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wav := new(bytes.Buffer)
+	writeWav(wav, &audioBuffer{44100, nil})
+	touch := func(name string) {
+		err := ioutil.WriteFile(filepath.Join(dir, name), wav.Bytes(), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	smp := newSamples(newNullEngine())
+	err = smp.readSamples(dir)
+	assert.Equal(t, err.Error(), "no samples in "+dir)
+
+	touch("kick.wav")
+	touch("snare.wav")
+	touch("notes.txt")
+	os.Mkdir(filepath.Join(dir, "pack.wav"), 0755)
+	err = smp.readSamples(dir)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, smp.paths(), map[string]string{
+		"kick":  filepath.Join(dir, "kick.wav"),
+		"snare": filepath.Join(dir, "snare.wav"),
+	})
+
+	touch("hat.aiff")
+	os.Rename(filepath.Join(dir, "snare.wav"), filepath.Join(dir, "clap.wav"))
+	os.Remove(filepath.Join(dir, "kick.wav"))
+	changes, err := smp.rescan()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, changes, []PoolChange{
+		{poolRename, "clap", "snare"},
+		{Type: poolAdd, Name: "hat"},
+		{Type: poolRemove, Name: "kick"},
+	})
+	path, exists := smp.lookup("clap")
+	assert.Equal(t, exists, true)
+	assert.Equal(t, path, filepath.Join(dir, "clap.wav"))
+	changes, err = smp.rescan()
+	assert.Equal(t, changes, []PoolChange{})
+
+	// directories are read whole, however large they are
+	for i := 0; i < 1100; i++ {
+		touch(fmt.Sprintf("tom%d.wav", i))
+	}
+	changes, err = smp.rescan()
+	assert.Equal(t, len(changes), 1100)
+	assert.Equal(t, len(smp.paths()), 1102)
+}
+
+func TestServerRescan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lightningd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "kick.wav"), nil, 0644)
+	srv := newTestServer(t)
+	err = srv.readSamples(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := srv.hub.subscribe()
+	handler := srv.rescan()
+
+	ioutil.WriteFile(filepath.Join(dir, "snare.flac"), nil, 0644)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/samples/rescan", nil))
+	assert.Equal(t, w.Code, http.StatusOK)
+	assert.Equal(t, strings.TrimSpace(w.Body.String()), `[{"type":"add","name":"snare"}]`)
+	up := <-updates
+	assert.Equal(t, up.Type, updateSamples)
+	assert.Equal(t, up.Samples, []PoolChange{{Type: poolAdd, Name: "snare"}})
+
+	// nothing is broadcast if the pool did not change
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/samples/rescan", nil))
+	assert.Equal(t, strings.TrimSpace(w.Body.String()), `[]`)
+	assert.Equal(t, len(updates), 0)
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/samples/rescan", nil))
+	assert.Equal(t, w.Code, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+// WAV format tags
+const (
+	wavPCM        = 1
+	wavFloat      = 3
+	wavExtensible = 0xFFFE
+)
+
+// audioBuffer is stereo audio, with each sample from -1 to 1
+type audioBuffer struct {
+	rate   int
+	frames [][2]float32
+}
+
+// readWav reads a PCM or floating point WAV file. Mono files
+// are read into both channels, and channels after the first
+// two are ignored.
+func readWav(r io.Reader) (*audioBuffer, error) {
+	bs, er := ioutil.ReadAll(r)
+	if er != nil {
+		return nil, er
+	}
+	if len(bs) < 12 || string(bs[:4]) != "RIFF" || string(bs[8:12]) != "WAVE" {
+		return nil, errors.New("not a wav file")
+	}
+	le := binary.LittleEndian
+	var format, channels, bits int
+	buf := new(audioBuffer)
+	for bs = bs[12:]; len(bs) >= 8; {
+		id, size := string(bs[:4]), le.Uint32(bs[4:8])
+		if uint64(size) > uint64(len(bs)-8) {
+			return nil, fmt.Errorf("wav %s chunk is longer than the file", id)
+		}
+		chunk := bs[8 : 8+size]
+		bs = bs[8+size:]
+		if size%2 == 1 && len(bs) > 0 {
+			// chunks are padded to an even size
+			bs = bs[1:]
+		}
+		switch id {
+		case "fmt ":
+			if len(chunk) < 16 {
+				return nil, errors.New("wav fmt chunk is too short")
+			}
+			format, channels = int(le.Uint16(chunk)), int(le.Uint16(chunk[2:]))
+			buf.rate, bits = int(le.Uint32(chunk[4:])), int(le.Uint16(chunk[14:]))
+			if format == wavExtensible && len(chunk) >= 26 {
+				// the format is the start of the sub format GUID
+				format = int(le.Uint16(chunk[24:]))
+			}
+		case "data":
+			if channels == 0 {
+				return nil, errors.New("wav data chunk before fmt chunk")
+			}
+			return buf, buf.decode(chunk, format, channels, bits)
+		}
+	}
+	return nil, errors.New("wav file has no data chunk")
+}
+
+// decode reads the frames in the data chunk of a WAV file
+func (self *audioBuffer) decode(data []byte, format, channels, bits int) error {
+	le := binary.LittleEndian
+	var sample func(b []byte) float32
+	switch {
+	case format == wavPCM && bits == 8:
+		sample = func(b []byte) float32 { return (float32(b[0]) - 128) / 128 }
+	case format == wavPCM && bits == 16:
+		sample = func(b []byte) float32 { return float32(int16(le.Uint16(b))) / (1 << 15) }
+	case format == wavPCM && bits == 24:
+		sample = func(b []byte) float32 {
+			return float32(int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24)>>8) / (1 << 23)
+		}
+	case format == wavPCM && bits == 32:
+		sample = func(b []byte) float32 { return float32(int32(le.Uint32(b))) / (1 << 31) }
+	case format == wavFloat && bits == 32:
+		sample = func(b []byte) float32 { return math.Float32frombits(le.Uint32(b)) }
+	default:
+		return fmt.Errorf("wav format %d with %d bits is not supported", format, bits)
+	}
+	width := bits / 8
+	frame := width * channels
+	self.frames = make([][2]float32, len(data)/frame)
+	for i := range self.frames {
+		b := data[i*frame:]
+		left := sample(b)
+		right := left
+		if channels > 1 {
+			right = sample(b[width:])
+		}
+		self.frames[i] = [2]float32{left, right}
+	}
+	return nil
+}
+
+// writeWav writes the buffer as a 16 bit stereo WAV file.
+// Samples outside -1 to 1 are clipped.
+func writeWav(w io.Writer, buf *audioBuffer) error {
+	ew := writeWavHeader(w, buf.rate, len(buf.frames))
+	if ew != nil {
+		return ew
+	}
+	return writeWavFrames(w, buf.frames)
+}
+
+// writeWavHeader writes the header of a 16 bit stereo WAV file
+// that holds a number of frames at rate. The frames follow
+// it, see writeWavFrames.
+func writeWavHeader(w io.Writer, rate, frames int) error {
+	le := binary.LittleEndian
+	size := uint32(frames * 4)
+	out := new(bytes.Buffer)
+	out.WriteString("RIFF")
+	binary.Write(out, le, 36+size)
+	out.WriteString("WAVEfmt ")
+	binary.Write(out, le, []uint32{16})
+	binary.Write(out, le, []uint16{wavPCM, 2})
+	binary.Write(out, le, []uint32{uint32(rate), uint32(rate * 4)})
+	binary.Write(out, le, []uint16{4, 16})
+	out.WriteString("data")
+	binary.Write(out, le, size)
+	_, ew := out.WriteTo(w)
+	return ew
+}
+
+// writeWavFrames writes frames as the 16 bit stereo data of a
+// WAV file. Samples outside -1 to 1 are clipped.
+func writeWavFrames(w io.Writer, frames [][2]float32) error {
+	le := binary.LittleEndian
+	data := make([]byte, len(frames)*4)
+	for i, frame := range frames {
+		for c, s := range frame {
+			v := math.Max(-1, math.Min(1, float64(s)))
+			le.PutUint16(data[i*4+c*2:], uint16(int16(math.Floor(v*32767+0.5))))
+		}
+	}
+	_, ew := w.Write(data)
+	return ew
+}